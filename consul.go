@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// consulConfig creates the consul client configuration. Settings
+// that are not configured keep the defaults of the consul API, which
+// includes the CONSUL_HTTP_* environment variables.
+func consulConfig(conf *Config) *consulapi.Config {
+	consulConf := consulapi.DefaultConfig()
+	if conf.Address != "" {
+		consulConf.Address = conf.Address
+	}
+	if conf.token != "" {
+		consulConf.Token = conf.token
+	}
+	if conf.Scheme != "" {
+		consulConf.Scheme = conf.Scheme
+	}
+
+	tlsConf := consulTLSConfig(conf)
+	if tlsConf.Address != "" {
+		consulConf.TLSConfig.Address = tlsConf.Address
+	}
+	if tlsConf.CAFile != "" {
+		consulConf.TLSConfig.CAFile = tlsConf.CAFile
+	}
+	if tlsConf.CAPath != "" {
+		consulConf.TLSConfig.CAPath = tlsConf.CAPath
+	}
+	if tlsConf.CertFile != "" {
+		consulConf.TLSConfig.CertFile = tlsConf.CertFile
+	}
+	if tlsConf.KeyFile != "" {
+		consulConf.TLSConfig.KeyFile = tlsConf.KeyFile
+	}
+	if tlsConf.InsecureSkipVerify {
+		consulConf.TLSConfig.InsecureSkipVerify = true
+	}
+	return consulConf
+}
+
+// consulTLSConfig returns the configured TLS settings
+func consulTLSConfig(conf *Config) consulapi.TLSConfig {
+	return consulapi.TLSConfig{
+		Address:            conf.TLSServerName,
+		CAFile:             conf.CAFile,
+		CAPath:             conf.CAPath,
+		CertFile:           conf.CertFile,
+		KeyFile:            conf.KeyFile,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+}
+
+// checkTLSConfig ensures the TLS settings are usable, by loading
+// any certificates and keys they refer to
+func checkTLSConfig(conf *Config) error {
+	tlsConf := consulTLSConfig(conf)
+	if _, err := consulapi.SetupTLSConfig(&tlsConf); err != nil {
+		return fmt.Errorf("invalid TLS configuration: %v", err)
+	}
+	return nil
+}
+
+// defaultAddress is used when no Consul address is configured
+const defaultAddress = "127.0.0.1:8500"
+
+// consulAddresses returns the Consul addresses in the order they
+// should be tried
+func (c *Config) consulAddresses() []string {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range append([]string{c.Address}, c.Addresses...) {
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, defaultAddress)
+	}
+	return addrs
+}
+
+// probeTimeout limits how long probing a single agent may take,
+// so an unresponsive address does not hold up a failover
+const probeTimeout = 5 * time.Second
+
+// failBackInterval is how often the preferred agent is probed
+// after failing over to another address
+const failBackInterval = 30 * time.Second
+
+// consulClients holds a client for each Consul address and tracks
+// which is in use. When the client in use fails, the addresses are
+// probed in order and the first healthy one is used instead.
+type consulClients struct {
+	sync.Mutex
+	addresses []string
+	clients   []*consulapi.Client
+	probes    []*consulapi.Client
+	current   int
+}
+
+// newConsulClients creates a client for each configured address,
+// along with a client with a short timeout used to probe it
+func newConsulClients(conf *Config) (*consulClients, error) {
+	c := &consulClients{addresses: conf.consulAddresses()}
+	for _, addr := range c.addresses {
+		consulConf := consulConfig(conf)
+		consulConf.Address = addr
+		client, err := consulapi.NewClient(consulConf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize consul client for %s: %v", addr, err)
+		}
+		c.clients = append(c.clients, client)
+
+		probeConf := consulConfig(conf)
+		probeConf.Address = addr
+		probeConf.HttpClient, err = consulapi.NewHttpClient(probeConf.Transport, probeConf.TLSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize consul client for %s: %v", addr, err)
+		}
+		probeConf.HttpClient.Timeout = probeTimeout
+		probe, err := consulapi.NewClient(probeConf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize consul client for %s: %v", addr, err)
+		}
+		c.probes = append(c.probes, probe)
+	}
+	return c, nil
+}
+
+// Client returns the client in use and its index, which
+// should be given to Failover if a request fails
+func (c *consulClients) Client() (*consulapi.Client, int) {
+	c.Lock()
+	defer c.Unlock()
+	return c.clients[c.current], c.current
+}
+
+// Probe checks each address in order and switches to the first
+// healthy one. Returns an error if none are healthy.
+func (c *consulClients) Probe() error {
+	idx := c.probe()
+	if idx < 0 {
+		return errors.New("no consul agent is available")
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.use(idx)
+	return nil
+}
+
+// probe returns the index of the first healthy agent, or -1 if
+// none are. The agents are contacted without holding the lock, so
+// other watches can keep using the current client meanwhile.
+func (c *consulClients) probe() int {
+	for idx, client := range c.probes {
+		err := pingAgent(client)
+		if err == nil {
+			return idx
+		}
+		log.Printf("[WARN] Consul agent at %s is unavailable: %v", c.addresses[idx], err)
+	}
+	return -1
+}
+
+// use switches to the client at index. Must be called with the lock held.
+func (c *consulClients) use(idx int) {
+	if idx != c.current {
+		log.Printf("[INFO] Switching to consul agent at %s", c.addresses[idx])
+		c.current = idx
+	}
+}
+
+// Failover is called when a request using the client at index failed.
+// If that client is still in use, the addresses are probed again.
+// Returns if a different client is now in use.
+func (c *consulClients) Failover(failed int) bool {
+	c.Lock()
+	current := c.current
+	c.Unlock()
+	if current != failed {
+		return true
+	}
+
+	idx := c.probe()
+	c.Lock()
+	defer c.Unlock()
+
+	// Another watch may have failed over while probing
+	if idx >= 0 && c.current == failed {
+		c.use(idx)
+	}
+	return c.current != failed
+}
+
+// FailBack switches back to the first address if another is in
+// use and the first agent is healthy again. Returns if it switched.
+func (c *consulClients) FailBack() bool {
+	c.Lock()
+	current := c.current
+	c.Unlock()
+	if current == 0 || pingAgent(c.probes[0]) != nil {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.current == 0 {
+		return false
+	}
+	log.Printf("[INFO] Consul agent at %s is available again", c.addresses[0])
+	c.use(0)
+	return true
+}
+
+// waitForAgent probes the agents with a backoff until one is
+// available. Returns false if stopped or the startup timeout passes.
+func waitForAgent(conf *Config, clients *consulClients, stopCh chan struct{}) bool {
+	var deadline <-chan time.Time
+	if conf.StartupTimeout > 0 && conf.Startup != StartupCache {
+		deadline = time.After(conf.StartupTimeout)
+	}
+	retry := newRetrier(conf)
+	for {
+		err := clients.Probe()
+		if err == nil {
+			return true
+		}
+		wait := retry.Failure(time.Now())
+		log.Printf("[ERR] Failed to contact consul agent, retrying in %v: %v", wait, err)
+		select {
+		case <-time.After(wait):
+		case <-deadline:
+			log.Printf("[ERR] No consul agent available after %v, giving up", conf.StartupTimeout)
+			return false
+		case <-stopCh:
+			return false
+		}
+	}
+}
+
+// pingAgent checks if an agent is reachable. A token without
+// agent read access is denied, but that still shows the agent
+// is reachable.
+func pingAgent(client *consulapi.Client) error {
+	if _, err := client.Agent().NodeName(); err != nil && !isPermissionDenied(err) {
+		return err
+	}
+	return nil
+}
+
+// isPermissionDenied checks if a request was rejected by ACLs
+func isPermissionDenied(err error) bool {
+	se, ok := err.(consulapi.StatusError)
+	return ok && se.Code == http.StatusForbidden
+}
+
+// consulError adds guidance to errors that need the operator to act,
+// such as a missing or insufficient ACL token
+func consulError(err error) error {
+	if isPermissionDenied(err) {
+		return fmt.Errorf("permission denied, check the ACL token grants "+
+			"read access to the service and its nodes: %v", err)
+	}
+	return err
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// testTLSServer starts a TLS stand-in for the Consul HTTP API which
+// answers health queries with an empty list. The CA certificate of
+// the server is written to dir.
+func testTLSServer(t *testing.T, dir string, clientCAs *x509.CertPool) (*httptest.Server, string) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "1")
+		w.Write([]byte("[]"))
+	}))
+	if clientCAs != nil {
+		srv.TLS = &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
+		}
+	}
+	srv.StartTLS()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		srv.Close()
+		t.Fatalf("err: %v", err)
+	}
+	return srv, caFile
+}
+
+// testClientCert creates a self-signed client certificate in dir,
+// returning the paths of the certificate and key
+func testClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "consul-haproxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return cert, certFile, keyFile
+}
+
+// testHealthQuery runs a health query against the configured address
+func testHealthQuery(conf *Config) error {
+	client, err := consulapi.NewClient(consulConfig(conf))
+	if err != nil {
+		return err
+	}
+	_, _, err = client.Health().Service("redis", "", true, nil)
+	return err
+}
+
+func TestConsulConfig_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, caFile := testTLSServer(t, dir, nil)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+
+	type match struct {
+		conf *Config
+		ok   bool
+	}
+	inps := []match{
+		{&Config{Address: addr, Scheme: "https"}, false},
+		{&Config{Address: addr, Scheme: "https", CAFile: caFile}, true},
+		{&Config{Address: addr, Scheme: "https", CAPath: dir}, true},
+		{&Config{Address: addr, Scheme: "https", CAFile: caFile, TLSServerName: "example.com"}, true},
+		{&Config{Address: addr, Scheme: "https", CAFile: caFile, TLSServerName: "consul.example.org"}, false},
+		{&Config{Address: addr, Scheme: "https", InsecureSkipVerify: true}, true},
+	}
+	for idx, inp := range inps {
+		err := testHealthQuery(inp.conf)
+		if inp.ok && err != nil {
+			t.Fatalf("%d: err: %v", idx, err)
+		}
+		if !inp.ok && err == nil {
+			t.Fatalf("%d: expected error", idx)
+		}
+	}
+}
+
+func TestConsulConfig_ClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, certFile, keyFile := testClientCert(t, dir)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	srv, caFile := testTLSServer(t, dir, pool)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+
+	// The server requires a client certificate
+	conf := &Config{Address: addr, Scheme: "https", CAFile: caFile}
+	if err := testHealthQuery(conf); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	conf.CertFile = certFile
+	conf.KeyFile = keyFile
+	if err := checkTLSConfig(conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := testHealthQuery(conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCheckTLSConfig(t *testing.T) {
+	if err := checkTLSConfig(&Config{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := checkTLSConfig(&Config{CAFile: "test-fixtures/missing.pem"}); err == nil {
+		t.Fatalf("expected error")
+	}
+	conf := &Config{CertFile: "test-fixtures/missing.pem", KeyFile: "test-fixtures/missing-key.pem"}
+	if err := checkTLSConfig(conf); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestConsulConfig_Token(t *testing.T) {
+	var tokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("X-Consul-Token"))
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	conf := &Config{Address: strings.TrimPrefix(srv.URL, "http://"), token: "secret"}
+	client, err := consulapi.NewClient(consulConfig(conf))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, _, err = client.Health().Service("redis", "", true, nil)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if len(tokens) != 1 || tokens[0] != "secret" {
+		t.Fatalf("bad: %v", tokens)
+	}
+
+	// A denied request is reported with guidance, without the token
+	if !isPermissionDenied(err) {
+		t.Fatalf("bad: %v", err)
+	}
+	msg := consulError(err).Error()
+	if !strings.Contains(msg, "ACL token") || strings.Contains(msg, "secret") {
+		t.Fatalf("bad: %v", msg)
+	}
+}
+
+func TestConsulError(t *testing.T) {
+	err := consulapi.StatusError{Code: 500, Body: "rpc error"}
+	if isPermissionDenied(err) {
+		t.Fatalf("unexpected permission denied")
+	}
+	if consulError(err) != err {
+		t.Fatalf("bad: %v", consulError(err))
+	}
+}
+
+func TestConfig_ConsulAddresses(t *testing.T) {
+	type match struct {
+		conf   *Config
+		expect []string
+	}
+	inps := []match{
+		{&Config{}, []string{"127.0.0.1:8500"}},
+		{&Config{Address: "10.0.0.1:8500"}, []string{"10.0.0.1:8500"}},
+		{&Config{Address: "10.0.0.1:8500", Addresses: []string{"10.0.0.2:8500", "10.0.0.1:8500"}},
+			[]string{"10.0.0.1:8500", "10.0.0.2:8500"}},
+		{&Config{Addresses: []string{"10.0.0.2:8500", "10.0.0.3:8500"}},
+			[]string{"10.0.0.2:8500", "10.0.0.3:8500"}},
+	}
+	for _, inp := range inps {
+		if out := inp.conf.consulAddresses(); !reflect.DeepEqual(out, inp.expect) {
+			t.Fatalf("bad: %v %v", out, inp.expect)
+		}
+	}
+}
+
+// testAgent is a stand-in for a Consul agent whose health can be changed
+type testAgent struct {
+	*httptest.Server
+	healthy bool
+}
+
+func newTestAgent() *testAgent {
+	a := &testAgent{healthy: true}
+	a.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.healthy {
+			http.Error(w, "agent unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"Config": {"NodeName": "node1"}}`))
+	}))
+	return a
+}
+
+func TestConsulClients_Failover(t *testing.T) {
+	a1 := newTestAgent()
+	defer a1.Close()
+	a2 := newTestAgent()
+	defer a2.Close()
+
+	conf := &Config{Addresses: []string{
+		strings.TrimPrefix(a1.URL, "http://"),
+		strings.TrimPrefix(a2.URL, "http://"),
+	}}
+	clients, err := newConsulClients(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The first healthy agent is used
+	a1.healthy = false
+	if err := clients.Probe(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, idx := clients.Client(); idx != 1 {
+		t.Fatalf("bad: %v", idx)
+	}
+
+	// A failure of a client no longer in use has already been handled
+	if !clients.Failover(0) {
+		t.Fatalf("expected failover")
+	}
+
+	// Agents are tried in order, so the first is preferred again
+	a1.healthy = true
+	if !clients.Failover(1) {
+		t.Fatalf("expected failover")
+	}
+	if _, idx := clients.Client(); idx != 0 {
+		t.Fatalf("bad: %v", idx)
+	}
+
+	// A healthy agent is kept
+	if clients.Failover(0) {
+		t.Fatalf("unexpected failover")
+	}
+
+	// No agent is available
+	a1.healthy = false
+	a2.healthy = false
+	if err := clients.Probe(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if clients.Failover(0) {
+		t.Fatalf("unexpected failover")
+	}
+}
+
+func TestConsulClients_FailBack(t *testing.T) {
+	a1 := newTestAgent()
+	defer a1.Close()
+	a2 := newTestAgent()
+	defer a2.Close()
+
+	conf := &Config{Addresses: []string{
+		strings.TrimPrefix(a1.URL, "http://"),
+		strings.TrimPrefix(a2.URL, "http://"),
+	}}
+	clients, err := newConsulClients(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Nothing to do while the first agent is in use
+	if clients.FailBack() {
+		t.Fatalf("unexpected fail back")
+	}
+
+	a1.healthy = false
+	if !clients.Failover(0) {
+		t.Fatalf("expected failover")
+	}
+
+	// The second agent is kept while the first is unavailable
+	if clients.FailBack() {
+		t.Fatalf("unexpected fail back")
+	}
+	if _, idx := clients.Client(); idx != 1 {
+		t.Fatalf("bad: %v", idx)
+	}
+
+	// The first agent is used again once it recovers
+	a1.healthy = true
+	if !clients.FailBack() {
+		t.Fatalf("expected fail back")
+	}
+	if _, idx := clients.Client(); idx != 0 {
+		t.Fatalf("bad: %v", idx)
+	}
+}
+
+func TestConsulClients_ProbeUnlocked(t *testing.T) {
+	release := make(chan struct{})
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"Config": {"NodeName": "node1"}}`))
+	}))
+	defer a.Close()
+	defer close(release)
+
+	conf := &Config{Address: strings.TrimPrefix(a.URL, "http://")}
+	clients, err := newConsulClients(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The client in use is available while an agent is slow to respond
+	go clients.Failover(0)
+	done := make(chan struct{})
+	go func() {
+		clients.Client()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("client blocked by probe")
+	}
+}
+
+func TestWaitForAgent(t *testing.T) {
+	a := newTestAgent()
+	defer a.Close()
+	conf := &Config{Address: strings.TrimPrefix(a.URL, "http://")}
+	clients, err := newConsulClients(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stopCh := make(chan struct{})
+	if !waitForAgent(conf, clients, stopCh) {
+		t.Fatalf("expected agent")
+	}
+
+	// Give up after the startup timeout
+	a.healthy = false
+	conf.StartupTimeout = 10 * time.Millisecond
+	if waitForAgent(conf, clients, stopCh) {
+		t.Fatalf("unexpected agent")
+	}
+
+	// Keep waiting until stopped when rendering from the cache
+	conf.Startup = StartupCache
+	close(stopCh)
+	if waitForAgent(conf, clients, stopCh) {
+		t.Fatalf("unexpected agent")
+	}
+}
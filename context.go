@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// These are the names in the template context that are not backends
+const (
+	contextBackends = "Backends"
+	contextRender   = "Render"
+)
+
+// BackendEntry describes a backend to templates
+type BackendEntry struct {
+	// Name is the name of the backend
+	Name string
+
+	// Servers are the servers of the backend
+	Servers []*ServerEntry
+
+	// Specs are the backend specifications of the backend
+	Specs []string
+
+	// Datacenters are the datacenters of the servers
+	Datacenters []string
+
+	// Status is the status of the backend, as returned by
+	// the status function
+	Status string
+
+	// Health counts the servers in each health state
+	Health HealthCounts
+
+	// Index is the highest Consul index returned
+	// by the watches of the backend
+	Index uint64
+
+	// LastContact is the longest time since the Consul leader was
+	// contacted for any watch of the backend, and KnownLeader is
+	// set if every watch had a known leader
+	LastContact time.Duration
+	KnownLeader bool
+
+	// IndexResets counts how often the index of any watch of
+	// the backend went backwards or was zero
+	IndexResets int
+}
+
+// HealthCounts are the number of servers in each health state
+type HealthCounts struct {
+	Passing     int
+	Warning     int
+	Critical    int
+	Maintenance int
+}
+
+// RenderEntry describes the render to templates
+type RenderEntry struct {
+	// Timestamp is when the templates were rendered. A file is not
+	// rewritten if only the timestamp has changed since it was written.
+	Timestamp time.Time
+
+	// Hostname is the host name of the machine
+	Hostname string
+
+	// Version is the version of consul-haproxy
+	Version string
+
+	// ConsulIndex is the highest Consul index returned by any watch
+	ConsulIndex uint64
+}
+
+// newTemplateContext creates the data passed to templates. The servers
+// of each backend are available by the name of the backend, as well as
+// a list of Backends sorted by name and the Render metadata.
+func newTemplateContext(data *backendData, servers map[string][]*WatchEntry,
+	status map[string]string) map[string]interface{} {
+	formatted := formatOutput(servers)
+	context := make(map[string]interface{}, len(formatted)+2)
+	for backend, list := range formatted {
+		context[backend] = list
+	}
+
+	data.Lock()
+	defer data.Unlock()
+	render := &RenderEntry{
+		Timestamp: time.Now(),
+		Version:   versionString(),
+	}
+	render.Hostname, _ = os.Hostname()
+
+	backends := make([]*BackendEntry, 0, len(formatted))
+	for name, list := range formatted {
+		backend := &BackendEntry{
+			Name:    name,
+			Servers: list,
+			Specs:   []string{},
+			Status:  status[name],
+		}
+		backend.KnownLeader = len(data.Backends[name]) > 0
+		for _, watch := range data.Backends[name] {
+			backend.Specs = append(backend.Specs, watch.Spec)
+			s := data.status[watch]
+			if s == nil {
+				backend.KnownLeader = false
+				continue
+			}
+			if s.Index > backend.Index {
+				backend.Index = s.Index
+			}
+			if s.LastContact > backend.LastContact {
+				backend.LastContact = s.LastContact
+			}
+			if !s.KnownLeader {
+				backend.KnownLeader = false
+			}
+			backend.IndexResets += s.IndexResets
+		}
+		if backend.Index > render.ConsulIndex {
+			render.ConsulIndex = backend.Index
+		}
+
+		datacenters := []string{}
+		for _, server := range list {
+			datacenters = append(datacenters, server.Datacenter)
+			switch server.Health {
+			case HealthPassing:
+				backend.Health.Passing++
+			case HealthWarning:
+				backend.Health.Warning++
+			case HealthCritical:
+				backend.Health.Critical++
+			case HealthMaint:
+				backend.Health.Maintenance++
+			}
+		}
+		sort.Strings(datacenters)
+		backend.Datacenters = unique(datacenters).([]string)
+		backends = append(backends, backend)
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].Name < backends[j].Name
+	})
+
+	context[contextBackends] = backends
+	context[contextRender] = render
+	return context
+}
+
+// withoutTimestamp returns a copy of the context whose Render has no
+// timestamp, to tell if a render differs only by when it was made
+func withoutTimestamp(context map[string]interface{}) map[string]interface{} {
+	stable := make(map[string]interface{}, len(context))
+	for key, value := range context {
+		stable[key] = value
+	}
+	if render, ok := context[contextRender].(*RenderEntry); ok {
+		copied := *render
+		copied.Timestamp = time.Time{}
+		stable[contextRender] = &copied
+	}
+	return stable
+}
+
+// contextStatus returns the status of each backend in the context
+func contextStatus(context map[string]interface{}) map[string]string {
+	status := make(map[string]string)
+	backends, _ := context[contextBackends].([]*BackendEntry)
+	for _, backend := range backends {
+		status[backend.Name] = backend.Status
+	}
+	return status
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// testContextData returns backend data with two backends, one of
+// which has servers in several datacenters and health states
+func testContextData() (*backendData, map[string][]*WatchEntry) {
+	servers := testTemplateServers()
+	servers["app"][1].Checks = consulapi.HealthChecks{
+		&consulapi.HealthCheck{CheckID: "web", Status: HealthWarning},
+	}
+	servers["app"][2].Checks = consulapi.HealthChecks{
+		&consulapi.HealthCheck{CheckID: "web", Status: HealthCritical},
+	}
+	servers["app"][3].Checks = consulapi.HealthChecks{
+		&consulapi.HealthCheck{CheckID: nodeMaintCheckID, Status: HealthCritical},
+	}
+	servers["db"] = nil
+
+	data := &backendData{}
+	wp1 := addTestWatch(data, "app", servers["app"][:2]...)
+	wp2 := addTestWatch(data, "app", servers["app"][2:]...)
+	wp3 := addTestWatch(data, "db")
+	wp1.Spec, wp2.Spec, wp3.Spec = "app=web@east", "app=web@west", "db=mysql"
+	data.status = map[*WatchPath]*watchStatus{
+		wp1: &watchStatus{Read: true, Index: 10, KnownLeader: true, LastContact: time.Second},
+		wp2: &watchStatus{Read: true, Index: 12, KnownLeader: true, LastContact: 3 * time.Second,
+			IndexResets: 2},
+		wp3: &watchStatus{Read: true, Index: 4},
+	}
+	return data, servers
+}
+
+func TestNewTemplateContext(t *testing.T) {
+	data, servers := testContextData()
+	status := map[string]string{"app": StatusOK, "db": StatusEmpty}
+	start := time.Now()
+	context := newTemplateContext(data, servers, status)
+
+	// Backends are still available by name
+	if app, ok := context["app"].([]*ServerEntry); !ok || len(app) != 4 {
+		t.Fatalf("bad: %#v", context["app"])
+	}
+
+	backends := context["Backends"].([]*BackendEntry)
+	if len(backends) != 2 || backends[0].Name != "app" || backends[1].Name != "db" {
+		t.Fatalf("bad: %v", backends)
+	}
+	app := backends[0]
+	if !reflect.DeepEqual(app.Specs, []string{"app=web@east", "app=web@west"}) {
+		t.Fatalf("bad: %v", app.Specs)
+	}
+	if !reflect.DeepEqual(app.Datacenters, []string{"EAST", "WEST"}) {
+		t.Fatalf("bad: %v", app.Datacenters)
+	}
+	if app.Health != (HealthCounts{Passing: 1, Warning: 1, Critical: 1, Maintenance: 1}) {
+		t.Fatalf("bad: %#v", app.Health)
+	}
+	if app.Status != StatusOK || app.Index != 12 || len(app.Servers) != 4 {
+		t.Fatalf("bad: %#v", app)
+	}
+	if !app.KnownLeader || app.LastContact != 3*time.Second || app.IndexResets != 2 {
+		t.Fatalf("bad: %#v", app)
+	}
+	db := backends[1]
+	if db.Status != StatusEmpty || db.Index != 4 || len(db.Servers) != 0 || db.KnownLeader ||
+		len(db.Datacenters) != 0 || len(db.Specs) != 1 {
+		t.Fatalf("bad: %#v", db)
+	}
+
+	render := context["Render"].(*RenderEntry)
+	hostname, _ := os.Hostname()
+	if render.Hostname != hostname || render.ConsulIndex != 12 || render.Timestamp.Before(start) {
+		t.Fatalf("bad: %#v", render)
+	}
+	if !strings.HasPrefix(render.Version, Version) {
+		t.Fatalf("bad: %v", render.Version)
+	}
+}
+
+func TestBuildTemplate_Context(t *testing.T) {
+	data, servers := testContextData()
+	status := map[string]string{"app": StatusOK, "db": StatusEmpty}
+	out, err := buildTemplate(nil, "test-fixtures/context.conf", newTemplateContext(data, servers, status))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect, err := ioutil.ReadFile("test-fixtures/context.conf.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect = bytes.Replace(expect, []byte("VERSION"), []byte(versionString()), -1)
+	if !bytes.Equal(out, expect) {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestForceRefresh_Timestamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, watches := testRefreshData()
+	templ := filepath.Join(dir, "haproxy.conf.tmpl")
+	path := filepath.Join(dir, "haproxy.cfg")
+	reloadOut := filepath.Join(dir, "reload_out")
+	contents := "# {{.Render.Timestamp.UnixNano}}\nservers {{len .app}}\n"
+	if err := ioutil.WriteFile(templ, []byte(contents), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf := &Config{
+		watches:       watches,
+		Templates:     []string{templ},
+		Paths:         []string{path},
+		ReloadCommand: "echo 'foo' >> " + reloadOut,
+	}
+
+	// Only a change other than the timestamp causes a reload
+	for i := 0; i < 2; i++ {
+		if forceRefresh(conf, d, conf.allOutputs()) {
+			t.Fatalf("unexpected exit")
+		}
+	}
+	d.Servers[watches[1]] = nil
+	if forceRefresh(conf, d, conf.allOutputs()) {
+		t.Fatalf("unexpected exit")
+	}
+
+	out, err := ioutil.ReadFile(reloadOut)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "foo\nfoo\n" {
+		t.Fatalf("bad: %s", out)
+	}
+	out, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.HasSuffix(string(out), "servers 1\n") {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// A file removed outside of consul-haproxy is written again
+	os.Remove(path)
+	if forceRefresh(conf, d, conf.allOutputs()) {
+		t.Fatalf("unexpected exit")
+	}
+	out, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.HasSuffix(string(out), "servers 1\n") {
+		t.Fatalf("bad: %s", out)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// stagedFile is a fully written temporary file that is waiting
+// to be renamed over its destination
+type stagedFile struct {
+	// Path is the destination, with any symlinks resolved
+	Path string
+
+	// TmpPath is the location of the staged contents
+	TmpPath string
+
+	committed bool
+}
+
+// stageFile writes the contents to a temporary file in the same
+// directory as path and syncs it to disk, ready to be committed. If
+// the destination already exists its mode, owner and group are copied,
+// otherwise the given mode is used.
+func stageFile(path string, contents []byte, mode os.FileMode) (*stagedFile, error) {
+	// Write through symlinks instead of replacing them
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	// Inherit the attributes of any existing file
+	existing, err := os.Stat(path)
+	if err == nil {
+		mode = existing.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Create the temporary file next to the destination so the
+	// rename does not cross file systems
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	staged := &stagedFile{Path: path, TmpPath: f.Name()}
+	success := false
+	defer func() {
+		if !success {
+			f.Close()
+			staged.Abort()
+		}
+	}()
+
+	if _, err := f.Write(contents); err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(mode); err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if err := copyOwner(f, existing); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	success = true
+	return staged, nil
+}
+
+// Commit atomically renames the staged file over its destination
+func (s *stagedFile) Commit() error {
+	if err := os.Rename(s.TmpPath, s.Path); err != nil {
+		return err
+	}
+	s.committed = true
+
+	// Persist the rename itself
+	return syncDir(filepath.Dir(s.Path))
+}
+
+// Abort removes the staged file if it has not been committed.
+// It is safe to call multiple times.
+func (s *stagedFile) Abort() {
+	if !s.committed {
+		os.Remove(s.TmpPath)
+	}
+}
+
+// writeFileAtomic replaces the file at path with the given contents.
+// The contents are staged in a temporary file and renamed into place,
+// so a reader (such as an HAProxy reload) only ever sees the old or the
+// new file, never a partial write.
+func writeFileAtomic(path string, contents []byte, mode os.FileMode) error {
+	staged, err := stageFile(path, contents, mode)
+	if err != nil {
+		return err
+	}
+	defer staged.Abort()
+	return staged.Commit()
+}
+
+// fileBackup is a snapshot of a file that can be restored later
+type fileBackup struct {
+	Path     string
+	Exists   bool
+	Contents []byte
+	Mode     os.FileMode
+}
+
+// backupFile takes a snapshot of the file at path. A missing file
+// is recorded so that restoring it removes the file again.
+func backupFile(path string) (*fileBackup, error) {
+	b := &fileBackup{Path: path}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b.Exists = true
+	b.Contents = contents
+	b.Mode = info.Mode().Perm()
+	return b, nil
+}
+
+// Restore puts the file back to the state of the snapshot
+func (b *fileBackup) Restore() error {
+	if !b.Exists {
+		err := os.Remove(b.Path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return writeFileAtomic(b.Path, b.Contents, b.Mode)
+}
+
+// fileContentsEqual checks if the file at path exists and
+// has exactly the given contents
+func fileContentsEqual(path string, contents []byte) bool {
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(current, contents)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestWriteFileAtomic_New(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "haproxy.cfg")
+	if err := writeFileAtomic(path, []byte("foo"), 0640); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "foo" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0640 {
+		t.Fatalf("bad: %v", info.Mode())
+	}
+
+	// Ensure no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("bad: %v", files)
+	}
+}
+
+func TestWriteFileAtomic_Existing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "haproxy.cfg")
+	if err := ioutil.WriteFile(path, []byte("old contents"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Chmod(path, 0604); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := writeFileAtomic(path, []byte("new"), 0660); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "new" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// The existing mode should be kept
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0604 {
+		t.Fatalf("bad: %v", info.Mode())
+	}
+}
+
+func TestWriteFileAtomic_Symlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on windows")
+	}
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target.cfg")
+	link := filepath.Join(dir, "haproxy.cfg")
+	if err := ioutil.WriteFile(target, []byte("old"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := writeFileAtomic(link, []byte("new"), 0660); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The link should still point at the updated target
+	info, err := os.Lstat(link)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("symlink replaced: %v", info.Mode())
+	}
+	out, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "new" {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestStageFile_Abort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "haproxy.cfg")
+	staged, err := stageFile(path, []byte("foo"), 0660)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out, err := ioutil.ReadFile(staged.TmpPath)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "foo" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	staged.Abort()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("bad: %v", files)
+	}
+}
+
+func TestBackupFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	existing := filepath.Join(dir, "existing.cfg")
+	missing := filepath.Join(dir, "missing.cfg")
+	if err := ioutil.WriteFile(existing, []byte("old"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	b1, err := backupFile(existing)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	b2, err := backupFile(missing)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Overwrite both files
+	for _, path := range []string{existing, missing} {
+		if err := writeFileAtomic(path, []byte("new"), 0660); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Restore and verify
+	if err := b1.Restore(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := b2.Restore(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := ioutil.ReadFile(existing)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "old" {
+		t.Fatalf("bad: %s", out)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestFileContentsEqual(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "haproxy.cfg")
+	if fileContentsEqual(path, nil) {
+		t.Fatalf("missing file should not be equal")
+	}
+	if err := ioutil.WriteFile(path, []byte("foo"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !fileContentsEqual(path, []byte("foo")) {
+		t.Fatalf("expected equal")
+	}
+	if fileContentsEqual(path, []byte("bar")) {
+		t.Fatalf("expected not equal")
+	}
+}
@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+)
+
+// copyOwner sets the owner and group of f to match the given file.
+// Only root may give a file away, so a user rewriting a file owned by
+// someone else keeps their own ownership, and only the group is copied
+// if they are a member of it.
+func copyOwner(f *os.File, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	// Skip the chown if the ownership already matches
+	current, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if cur, ok := current.Sys().(*syscall.Stat_t); ok &&
+		cur.Uid == stat.Uid && cur.Gid == stat.Gid {
+		return nil
+	}
+
+	err = f.Chown(int(stat.Uid), int(stat.Gid))
+	if err == nil || !os.IsPermission(err) {
+		return err
+	}
+	log.Printf("[WARN] Cannot keep the owner of %s, keeping only the group: %v", f.Name(), err)
+	if err := f.Chown(-1, int(stat.Gid)); err != nil {
+		log.Printf("[WARN] Cannot keep the group of %s: %v", f.Name(), err)
+	}
+	return nil
+}
+
+// syncDir flushes a directory so that a rename within it is durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
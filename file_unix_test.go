@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// ownerInfo reports the given owner for an otherwise real file
+type ownerInfo struct {
+	os.FileInfo
+	stat *syscall.Stat_t
+}
+
+func (i ownerInfo) Sys() interface{} { return i.stat }
+
+func TestCopyOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(filepath.Join(dir, "haproxy.cfg"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Same owner is a no-op
+	if err := copyOwner(f, info); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A file owned by someone else is not an error, even when
+	// only root is allowed to change the owner
+	stat := *info.Sys().(*syscall.Stat_t)
+	stat.Uid++
+	stat.Gid++
+	if err := copyOwner(f, ownerInfo{info, &stat}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
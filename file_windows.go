@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// copyOwner is a no-op, Windows does not have POSIX ownership
+func copyOwner(f *os.File, info os.FileInfo) error {
+	return nil
+}
+
+// syncDir is a no-op, Windows does not support syncing a directory
+func syncDir(dir string) error {
+	return nil
+}
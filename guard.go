@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// GuardConfig limits how many servers a backend may lose in a single
+// update, protecting against a Consul failure or bad ACL change that
+// returns too few servers
+type GuardConfig struct {
+	// Backend is the backend the guard applies to
+	Backend string `mapstructure:"backend"`
+
+	// MinServers is the number of active servers a backend may not
+	// drop below. Zero uses the global setting, and guardDisabled
+	// disables the check for the backend.
+	MinServers int `mapstructure:"min_servers"`
+
+	// MaxRemovePercent is the largest percentage of active servers
+	// that may be removed in one update. Zero uses the global setting,
+	// and guardDisabled disables the check for the backend.
+	MaxRemovePercent int `mapstructure:"max_remove_percent"`
+
+	// Override applies updates even if they trip the guard
+	Override bool `mapstructure:"override"`
+}
+
+// guardDisabled turns off a check of a backend guard
+// that is enabled by the global settings
+const guardDisabled = -1
+
+// guardFor returns the guard of a backend, with defaults
+// from the global settings
+func (c *Config) guardFor(backend string) *GuardConfig {
+	guard := &GuardConfig{
+		Backend:          backend,
+		MinServers:       c.MinServers,
+		MaxRemovePercent: c.MaxRemovePercent,
+		Override:         c.GuardOverride,
+	}
+	for _, g := range c.Guards {
+		if g.Backend != backend {
+			continue
+		}
+		if g.MinServers != 0 {
+			guard.MinServers = g.MinServers
+		}
+		if g.MaxRemovePercent != 0 {
+			guard.MaxRemovePercent = g.MaxRemovePercent
+		}
+		if g.Override {
+			guard.Override = true
+		}
+	}
+	return guard
+}
+
+// check compares the active servers of an update with those
+// currently applied, and returns why the update is refused
+func (g *GuardConfig) check(old, new []*WatchEntry) error {
+	oldActive := activeEntries(old)
+	newActive := activeEntries(new)
+	if g.MinServers > 0 && len(newActive) < g.MinServers && len(newActive) < len(oldActive) {
+		return fmt.Errorf("%d active servers is below the minimum of %d",
+			len(newActive), g.MinServers)
+	}
+	if g.MaxRemovePercent > 0 && len(oldActive) > 0 {
+		removed := 0
+		for key := range oldActive {
+			if !newActive[key] {
+				removed++
+			}
+		}
+		percent := removed * 100 / len(oldActive)
+		if percent > g.MaxRemovePercent {
+			return fmt.Errorf("removing %d of %d active servers (%d%%) exceeds the maximum of %d%%",
+				removed, len(oldActive), percent, g.MaxRemovePercent)
+		}
+	}
+	return nil
+}
+
+// activeEntries returns the entries that receive traffic,
+// keyed by node and service ID
+func activeEntries(entries []*WatchEntry) map[string]bool {
+	active := make(map[string]bool)
+	for _, entry := range entries {
+		switch aggregateHealth(entry.Checks) {
+		case HealthCritical, HealthMaint:
+			continue
+		}
+		active[entry.Node.Node+"/"+entry.Service.ID] = true
+	}
+	return active
+}
+
+// guardServers checks each backend against its guard, keeping the
+// currently applied servers of any backend whose update is refused.
+// Returns the servers to apply and if any guard was tripped.
+func guardServers(conf *Config, data *backendData,
+	servers map[string][]*WatchEntry) (map[string][]*WatchEntry, bool) {
+	// Nothing is applied yet, so there is nothing to compare with
+	if data.guardedServers == nil {
+		return servers, false
+	}
+
+	tripped := false
+	guarded := make(map[string][]*WatchEntry, len(servers))
+	for backend, entries := range servers {
+		guarded[backend] = entries
+		old, ok := data.guardedServers[backend]
+		if !ok {
+			continue
+		}
+		guard := conf.guardFor(backend)
+		err := guard.check(old, entries)
+		if err != nil && guard.Override {
+			log.Printf("[WARN] Guard for backend '%s' overridden: %v", backend, err)
+			err = nil
+		}
+		if err == nil {
+			if data.trippedGuards[backend] {
+				log.Printf("[INFO] Guard for backend '%s' is no longer tripped", backend)
+				delete(data.trippedGuards, backend)
+			}
+			continue
+		}
+		log.Printf("[ERR] Guard for backend '%s' tripped, keeping previous servers: %v", backend, err)
+		guarded[backend] = old
+		tripped = true
+
+		// Only alert when the guard trips, not for every
+		// update while it stays tripped
+		if data.trippedGuards[backend] {
+			continue
+		}
+		if data.trippedGuards == nil {
+			data.trippedGuards = make(map[string]bool)
+		}
+		data.trippedGuards[backend] = true
+		alertGuard(conf, backend, err)
+	}
+	return guarded, tripped
+}
+
+// alertGuard invokes the alert command for a tripped guard
+func alertGuard(conf *Config, backend string, reason error) {
+	if conf.AlertCommand == "" || conf.DryRun {
+		return
+	}
+	err := runCommand(conf.AlertCommand,
+		"CONSUL_HAPROXY_BACKEND="+backend,
+		"CONSUL_HAPROXY_REASON="+reason.Error())
+	if err != nil {
+		log.Printf("[ERR] Failed to invoke alert command: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// testEntries creates n passing entries for a backend
+func testEntries(n int) []*WatchEntry {
+	entries := make([]*WatchEntry, n)
+	for i := range entries {
+		entries[i] = testWatchEntry(fmt.Sprintf("node%d", i+1), "127.0.0.1", "app", 8000+i)
+	}
+	return entries
+}
+
+func TestConfig_GuardFor(t *testing.T) {
+	conf := &Config{
+		MinServers:       1,
+		MaxRemovePercent: 50,
+		Guards: []*GuardConfig{
+			&GuardConfig{Backend: "app", MinServers: 3},
+			&GuardConfig{Backend: "db", MaxRemovePercent: 100, Override: true},
+			&GuardConfig{Backend: "web", MinServers: -1, MaxRemovePercent: -1},
+		},
+	}
+	type match struct {
+		backend string
+		expect  *GuardConfig
+	}
+	inps := []match{
+		{"app", &GuardConfig{Backend: "app", MinServers: 3, MaxRemovePercent: 50}},
+		{"db", &GuardConfig{Backend: "db", MinServers: 1, MaxRemovePercent: 100, Override: true}},
+		{"cache", &GuardConfig{Backend: "cache", MinServers: 1, MaxRemovePercent: 50}},
+		{"web", &GuardConfig{Backend: "web", MinServers: -1, MaxRemovePercent: -1}},
+	}
+	for _, inp := range inps {
+		if out := conf.guardFor(inp.backend); !reflect.DeepEqual(out, inp.expect) {
+			t.Fatalf("bad: %#v %#v", out, inp.expect)
+		}
+	}
+}
+
+func TestGuardConfig_Check(t *testing.T) {
+	entries := testEntries(4)
+	critical := &WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
+		Node:    entries[3].Node,
+		Service: entries[3].Service,
+		Checks:  []*consulapi.HealthCheck{&consulapi.HealthCheck{Status: HealthCritical}},
+	}}
+	type match struct {
+		guard *GuardConfig
+		old   []*WatchEntry
+		new   []*WatchEntry
+		ok    bool
+	}
+	inps := []match{
+		{&GuardConfig{}, entries, nil, true},
+		{&GuardConfig{MinServers: 2}, entries, entries[:2], true},
+		{&GuardConfig{MinServers: 2}, entries, entries[:1], false},
+		{&GuardConfig{MinServers: 2}, nil, entries[:1], true},
+		{&GuardConfig{MinServers: 4}, entries, append(entries[:3:3], critical), false},
+		{&GuardConfig{MaxRemovePercent: 50}, entries, entries[2:], true},
+		{&GuardConfig{MaxRemovePercent: 50}, entries, entries[3:], false},
+		{&GuardConfig{MaxRemovePercent: 50}, entries, nil, false},
+		{&GuardConfig{MaxRemovePercent: 50}, entries[:1], testEntries(1)[:0], false},
+		{&GuardConfig{MaxRemovePercent: 25}, entries[:2], entries, true},
+	}
+	for idx, inp := range inps {
+		err := inp.guard.check(inp.old, inp.new)
+		if inp.ok && err != nil {
+			t.Fatalf("%d: err: %v", idx, err)
+		}
+		if !inp.ok && err == nil {
+			t.Fatalf("%d: expected error", idx)
+		}
+	}
+}
+
+func TestGuardServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	alertOut := filepath.Join(dir, "alert_out")
+
+	entries := testEntries(4)
+	conf := &Config{
+		MaxRemovePercent: 50,
+		AlertCommand:     "echo $CONSUL_HAPROXY_BACKEND >> " + alertOut,
+	}
+	d := &backendData{}
+
+	// Nothing has been applied yet
+	servers := map[string][]*WatchEntry{"app": nil, "db": entries}
+	out, tripped := guardServers(conf, d, servers)
+	if tripped || !reflect.DeepEqual(out, servers) {
+		t.Fatalf("bad: %v %v", out, tripped)
+	}
+
+	// Only the backend losing too many servers is held back
+	d.guardedServers = map[string][]*WatchEntry{"app": entries, "db": entries}
+	servers = map[string][]*WatchEntry{"app": nil, "db": entries[1:]}
+	out, tripped = guardServers(conf, d, servers)
+	if !tripped {
+		t.Fatalf("expected trip")
+	}
+	expect := map[string][]*WatchEntry{"app": entries, "db": entries[1:]}
+	if !reflect.DeepEqual(out, expect) {
+		t.Fatalf("bad: %v", out)
+	}
+	raw, err := ioutil.ReadFile(alertOut)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if strings.TrimSpace(string(raw)) != "app" {
+		t.Fatalf("bad: %s", raw)
+	}
+
+	// The alert is only sent again after the guard recovers
+	for i := 0; i < 2; i++ {
+		if _, tripped = guardServers(conf, d, servers); !tripped {
+			t.Fatalf("expected trip")
+		}
+	}
+	if _, tripped = guardServers(conf, d, d.guardedServers); tripped {
+		t.Fatalf("unexpected trip")
+	}
+	if _, tripped = guardServers(conf, d, servers); !tripped {
+		t.Fatalf("expected trip")
+	}
+	raw, err = ioutil.ReadFile(alertOut)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(raw) != "app\napp\n" {
+		t.Fatalf("bad: %s", raw)
+	}
+
+	// The guard can be overridden
+	conf.Guards = []*GuardConfig{&GuardConfig{Backend: "app", Override: true}}
+	out, tripped = guardServers(conf, d, servers)
+	if tripped || !reflect.DeepEqual(out, servers) {
+		t.Fatalf("bad: %v %v", out, tripped)
+	}
+}
+
+func TestForceRefresh_Guard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, watches := testRefreshData()
+	path := filepath.Join(dir, "haproxy.cfg")
+	conf := &Config{
+		watches:       watches,
+		Templates:     []string{"test-fixtures/simple.conf"},
+		Paths:         []string{path},
+		ReloadCommand: "true",
+		MinServers:    2,
+		StateFile:     filepath.Join(dir, "state.json"),
+	}
+	if forceRefresh(conf, d, conf.allOutputs()) {
+		t.Fatalf("unexpected exit")
+	}
+	expect, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	os.Remove(conf.StateFile)
+
+	// Losing a server is refused, keeping the rendered configuration
+	d.Servers[watches[1]] = nil
+	if forceRefresh(conf, d, conf.allOutputs()) {
+		t.Fatalf("unexpected exit")
+	}
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != string(expect) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// The refused update is not saved as the last known good state
+	if _, err := os.Stat(conf.StateFile); !os.IsNotExist(err) {
+		t.Fatalf("err: %v", err)
+	}
+}
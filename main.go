@@ -11,7 +11,6 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
@@ -20,21 +19,6 @@ import (
 	"github.com/mitchellh/mapstructure"
 )
 
-// WatchRE is used to parse a backend configuration. The config should
-// look like "backend=tag.service@datacenter:port". However, the tag, port and
-// datacenter are optional, so it can also be provided as "backend=service"
-var WatchRE = regexp.MustCompile("^([^=]+)=([^.]+\\.)?([^.:@]+)(@[^.:]+)?(:[0-9]+)?$")
-
-// WatchPath represents a path we need to watch
-type WatchPath struct {
-	Spec       string
-	Backend    string
-	Service    string
-	Tag        string
-	Datacenter string
-	Port       int
-}
-
 // Config is used to configure the HAProxy connector
 type Config struct {
 	// DryRun is used to avoid actually modifying the file
@@ -44,6 +28,39 @@ type Config struct {
 	// Address is the Consul HTTP API address
 	Address string `mapstructure:"address"`
 
+	// Addresses are further Consul HTTP API addresses. The agents
+	// are tried in order, starting with Address, and the first
+	// healthy one is used.
+	Addresses []string `mapstructure:"addresses"`
+
+	// Token is the ACL token used for Consul requests
+	Token string `mapstructure:"token"`
+
+	// TokenFile is the path of a file containing the ACL token. It is
+	// read at startup and again when the configuration is reloaded.
+	TokenFile string `mapstructure:"token_file"`
+
+	// Scheme is the URI scheme of the Consul HTTP API, http or https
+	Scheme string `mapstructure:"scheme"`
+
+	// CAFile and CAPath are a PEM encoded CA certificate file and a
+	// directory of them used to verify the Consul server
+	CAFile string `mapstructure:"ca_file"`
+	CAPath string `mapstructure:"ca_path"`
+
+	// CertFile and KeyFile are a PEM encoded client certificate
+	// and key, used when Consul verifies incoming connections
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+
+	// TLSServerName is the server name used to verify the
+	// certificate, if it differs from the address
+	TLSServerName string `mapstructure:"tls_server_name"`
+
+	// InsecureSkipVerify disables verification of the
+	// server certificate
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+
 	// Path to the HAProxy template file
 	Templates []string `mapstructure:"templates"`
 
@@ -53,8 +70,13 @@ type Config struct {
 	// Command used to reload HAProxy
 	ReloadCommand string `mapstructure:"reload_command"`
 
+	// CheckCommand is used to validate a rendered configuration
+	// before it replaces the existing file. Any "{{path}}" in the
+	// command is replaced with the path of the rendered file.
+	CheckCommand string `mapstructure:"check_command"`
+
 	// Backends are used to specify what we watch. Given as:
-	// "name=(tag.)service"
+	// "name=(tag.)(!tag.)service(@dc)(:port)(?health=state&address=node)"
 	Backends []string `mapstructure:"backends"`
 
 	// Quiet is how long we wait for a "quiet" period before
@@ -70,8 +92,230 @@ type Config struct {
 	// Quiet value if not provided.
 	MaxWait time.Duration `mapstructure:"max_wait"`
 
+	// RuntimeSocket is the address of the HAProxy stats socket. If set,
+	// changes to the RuntimeBackends are applied to server-template
+	// slots using the Runtime API instead of reloading when possible.
+	RuntimeSocket string `mapstructure:"runtime_socket"`
+
+	// RuntimeBackends are the backends managed using the Runtime API.
+	// Given as: "name=haproxy_backend/server_prefix"
+	RuntimeBackends []string `mapstructure:"runtime_backends"`
+
+	// Startup controls what happens while no Consul agent is available
+	// at startup, either StartupWait or StartupCache
+	Startup string `mapstructure:"startup"`
+
+	// StartupTimeout limits how long StartupWait waits for an agent
+	// before giving up. Zero waits indefinitely.
+	StartupTimeout time.Duration `mapstructure:"startup_timeout"`
+
+	// StateFile is where the last known good service data is saved
+	StateFile string `mapstructure:"state_file"`
+
+	// MinServers and MaxRemovePercent are the default guards of each
+	// backend, refusing updates that leave fewer active servers or
+	// remove a larger percentage of them. Zero disables a check.
+	MinServers       int `mapstructure:"min_servers"`
+	MaxRemovePercent int `mapstructure:"max_remove_percent"`
+
+	// GuardOverride applies updates even if they trip a guard
+	GuardOverride bool `mapstructure:"guard_override"`
+
+	// Guards override the guard settings of individual backends
+	Guards []*GuardConfig `mapstructure:"guards"`
+
+	// AlertCommand is invoked when a guard is tripped
+	AlertCommand string `mapstructure:"alert_command"`
+
+	// Consistency is the consistency mode of the queries, one of
+	// ConsistencyDefault, ConsistencyStale or ConsistencyConsistent
+	Consistency string `mapstructure:"consistency"`
+
+	// MaxStale limits how far behind the leader a stale result may
+	// be. Results that are further behind are read from the leader.
+	MaxStale time.Duration `mapstructure:"max_stale"`
+
+	// WaitTime is how long a blocking query waits for a change
+	WaitTime time.Duration `mapstructure:"wait_time"`
+
+	// QueryInterval is the minimum time between the queries of a
+	// watch, limiting how fast a watch can spin if its queries stop
+	// blocking. Defaults to one second.
+	QueryInterval time.Duration `mapstructure:"query_interval"`
+
+	// RetryBase and RetryMax bound the delay before retrying after
+	// a failure. The limit doubles with each consecutive failure from
+	// RetryBase up to RetryMax, and a random delay up to the limit is
+	// used. Default to 5s and 80s.
+	RetryBase time.Duration `mapstructure:"retry_base"`
+	RetryMax  time.Duration `mapstructure:"retry_max"`
+
+	// RetryReset is how long a watch must go without failures before
+	// the delay starts from RetryBase again. Zero resets on any success.
+	RetryReset time.Duration `mapstructure:"retry_reset"`
+
+	// Sort is the order of the servers of each backend, one of
+	// SortNode, SortID, SortAddress or SortConsul
+	Sort string `mapstructure:"sort"`
+
+	// ErrorPolicy controls rendering while watches are failing,
+	// one of PolicyWait, PolicyRender or PolicyHold
+	ErrorPolicy string `mapstructure:"error_policy"`
+
+	// PartialsDir is a directory of partials available to every
+	// template, each named after its file without the extension
+	PartialsDir string `mapstructure:"partials_dir"`
+
+	// Outputs are templates configured with their own settings.
+	// Any setting not provided defaults to the global value.
+	Outputs []*OutputConfig `mapstructure:"outputs"`
+
 	// watches are the watches we need to track
 	watches []*WatchPath
+
+	// runtimeBackends are the parsed RuntimeBackends
+	runtimeBackends []*RuntimeBackend
+
+	// templates are the parsed templates
+	templates *templateCache
+
+	// token is the ACL token resolved from Token, TokenFile or
+	// the environment. It must never be logged.
+	token string
+}
+
+// OutputConfig is used to configure a single template and
+// the file it is rendered to
+type OutputConfig struct {
+	// Template is the path to the template file
+	Template string `mapstructure:"template"`
+
+	// Path is the path of the file to write
+	Path string `mapstructure:"path"`
+
+	// ReloadCommand is invoked when the file changes
+	ReloadCommand string `mapstructure:"reload_command"`
+
+	// CheckCommand validates the rendered file before it is installed
+	CheckCommand string `mapstructure:"check_command"`
+
+	// Mode is the octal file mode used when creating the file,
+	// such as "0644". An existing file keeps its mode.
+	Mode string `mapstructure:"mode"`
+
+	// Runtime marks the HAProxy configuration whose servers are updated
+	// using the Runtime API. It is not rendered when a change is applied
+	// that way, while the other outputs still are.
+	Runtime bool `mapstructure:"runtime"`
+
+	// Quiet and MaxWait control the quiet period for this template.
+	// Settings that are not provided use the global value, so zero
+	// can be given to disable a global quiet period.
+	Quiet   *time.Duration `mapstructure:"quiet"`
+	MaxWait *time.Duration `mapstructure:"max_wait"`
+
+	// mode is the parsed Mode
+	mode os.FileMode
+
+	// quiet and maxWait are the quiet period with the
+	// global defaults applied
+	quiet   time.Duration
+	maxWait time.Duration
+}
+
+// defaultFileMode is used when creating a new output file
+const defaultFileMode os.FileMode = 0660
+
+// These are the error policies. PolicyWait renders once every watch
+// has returned servers, using the last servers of a watch that fails
+// afterwards. PolicyRender also renders while watches have failed
+// without returning servers, and PolicyHold renders nothing while any
+// watch is failing.
+const (
+	PolicyWait   = "wait"
+	PolicyRender = "render"
+	PolicyHold   = "hold"
+)
+
+// These are the orders of the servers of a backend. SortNode sorts
+// by node name, SortID by service ID, and SortAddress by address and
+// port. SortConsul keeps the order the watches are configured in and
+// the order Consul returned the servers in, which may vary.
+const (
+	SortNode    = "node"
+	SortID      = "id"
+	SortAddress = "address"
+	SortConsul  = "consul"
+)
+
+// These are the startup behaviours. StartupWait waits for an agent
+// before rendering anything, while StartupCache renders from the state
+// file immediately and then keeps retrying.
+const (
+	StartupWait  = "wait"
+	StartupCache = "cache"
+)
+
+// allOutputs returns every output to render. The Templates and Paths
+// lists are merged with the Outputs, and defaults are applied from
+// the global settings.
+func (c *Config) allOutputs() []*OutputConfig {
+	var outputs []*OutputConfig
+	for idx, t := range c.Templates {
+		out := &OutputConfig{Template: t}
+		if idx < len(c.Paths) {
+			out.Path = c.Paths[idx]
+		}
+		outputs = append(outputs, out)
+	}
+	for _, o := range c.Outputs {
+		out := *o
+		outputs = append(outputs, &out)
+	}
+
+	for _, out := range outputs {
+		if out.ReloadCommand == "" {
+			out.ReloadCommand = c.ReloadCommand
+		}
+		if out.CheckCommand == "" {
+			out.CheckCommand = c.CheckCommand
+		}
+		out.mode = defaultFileMode
+		if out.Mode != "" {
+			if mode, err := parseFileMode(out.Mode); err == nil {
+				out.mode = mode
+			}
+		}
+		out.quiet, out.maxWait = c.Quiet, c.MaxWait
+		if out.Quiet != nil {
+			out.quiet, out.maxWait = *out.Quiet, 0
+		}
+		if out.MaxWait != nil {
+			out.maxWait = *out.MaxWait
+		}
+		if out.quiet != 0 && out.maxWait == 0 {
+			out.maxWait = 4 * out.quiet
+		}
+	}
+
+	// Without an output marked as the HAProxy configuration, the
+	// first one is updated using the Runtime API
+	if c.RuntimeSocket != "" && !includesRuntime(outputs) && len(outputs) > 0 {
+		outputs[0].Runtime = true
+	}
+	return outputs
+}
+
+// parseFileMode parses an octal file mode such as "0644"
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if os.FileMode(mode)&^os.ModePerm != 0 {
+		return 0, fmt.Errorf("invalid permissions '%s'", s)
+	}
+	return os.FileMode(mode), nil
 }
 
 func main() {
@@ -84,19 +328,50 @@ func getConfig() (*Config, error) {
 	var backends []string
 	var templates  []string
 	var paths []string
+	var runtimeBackends []string
+	var addresses []string
 
 	conf := &Config{}
 	cmdFlags := flag.NewFlagSet("consul-haproxy", flag.ContinueOnError)
 	cmdFlags.Usage = usage
-	cmdFlags.StringVar(&conf.Address, "addr", "127.0.0.1:8500", "consul HTTP API address with port")
+	cmdFlags.Var((*AppendSliceValue)(&addresses), "addr", "consul HTTP API address with port")
+	cmdFlags.StringVar(&conf.Token, "token", "", "consul ACL token")
+	cmdFlags.StringVar(&conf.TokenFile, "token-file", "", "file containing the consul ACL token")
+	cmdFlags.StringVar(&conf.Scheme, "scheme", "", "consul HTTP API scheme")
+	cmdFlags.StringVar(&conf.CAFile, "ca-file", "", "CA certificate file")
+	cmdFlags.StringVar(&conf.CAPath, "ca-path", "", "directory of CA certificates")
+	cmdFlags.StringVar(&conf.CertFile, "cert-file", "", "client certificate file")
+	cmdFlags.StringVar(&conf.KeyFile, "key-file", "", "client key file")
+	cmdFlags.StringVar(&conf.TLSServerName, "tls-server-name", "", "server name to verify")
+	cmdFlags.BoolVar(&conf.InsecureSkipVerify, "insecure-skip-verify", false, "skip server verification")
 	cmdFlags.Var((*AppendSliceValue)(&templates), "in", "template path")
 	cmdFlags.Var((*AppendSliceValue)(&paths), "out", "config path")
+	cmdFlags.StringVar(&conf.PartialsDir, "partials", "", "directory of template partials")
 	cmdFlags.StringVar(&conf.ReloadCommand, "reload", "", "reload command")
+	cmdFlags.StringVar(&conf.CheckCommand, "check", "", "config check command")
 	cmdFlags.StringVar(&configFile, "f", "", "config file")
 	cmdFlags.BoolVar(&conf.DryRun, "dry", false, "dry run")
 	cmdFlags.DurationVar(&conf.Quiet, "quiet", 0, "quiet period")
 	cmdFlags.DurationVar(&conf.MaxWait, "max-wait", 0, "maximum wait for a quiet period")
 	cmdFlags.Var((*AppendSliceValue)(&backends), "backend", "backend to populate")
+	cmdFlags.StringVar(&conf.RuntimeSocket, "runtime-socket", "", "HAProxy stats socket")
+	cmdFlags.Var((*AppendSliceValue)(&runtimeBackends), "runtime-backend", "backend to update at runtime")
+	cmdFlags.StringVar(&conf.Startup, "startup", StartupWait, "startup behaviour")
+	cmdFlags.DurationVar(&conf.StartupTimeout, "startup-timeout", 0, "maximum wait for an agent at startup")
+	cmdFlags.StringVar(&conf.StateFile, "state-file", "", "path to save the last known state")
+	cmdFlags.StringVar(&conf.Consistency, "consistency", ConsistencyDefault, "query consistency mode")
+	cmdFlags.DurationVar(&conf.MaxStale, "max-stale", 0, "maximum staleness of stale queries")
+	cmdFlags.DurationVar(&conf.WaitTime, "wait", 0, "blocking query wait time")
+	cmdFlags.DurationVar(&conf.QueryInterval, "query-interval", queryInterval, "minimum time between queries")
+	cmdFlags.DurationVar(&conf.RetryBase, "retry-base", 0, "base retry interval")
+	cmdFlags.DurationVar(&conf.RetryMax, "retry-max", 0, "maximum retry interval")
+	cmdFlags.DurationVar(&conf.RetryReset, "retry-reset", 0, "time without failures to reset the retry interval")
+	cmdFlags.StringVar(&conf.Sort, "sort", SortNode, "order of the servers of a backend")
+	cmdFlags.StringVar(&conf.ErrorPolicy, "error-policy", PolicyWait, "rendering policy while watches fail")
+	cmdFlags.IntVar(&conf.MinServers, "min-servers", 0, "minimum active servers per backend")
+	cmdFlags.IntVar(&conf.MaxRemovePercent, "max-remove", 0, "maximum percentage of servers removed per update")
+	cmdFlags.BoolVar(&conf.GuardOverride, "guard-override", false, "apply updates that trip a guard")
+	cmdFlags.StringVar(&conf.AlertCommand, "alert", "", "command to invoke when a guard is tripped")
 	if err := cmdFlags.Parse(os.Args[1:]); err != nil {
 		return nil, err
 	}
@@ -112,6 +387,8 @@ func getConfig() (*Config, error) {
 	conf.Templates = append(conf.Templates, templates...)
 	conf.Paths = append(conf.Paths, paths...)
 	conf.Backends = append(conf.Backends, backends...)
+	conf.RuntimeBackends = append(conf.RuntimeBackends, runtimeBackends...)
+	conf.Addresses = append(conf.Addresses, addresses...)
 	return conf, nil
 }
 
@@ -159,28 +436,45 @@ func readConfig(path string, config *Config) error {
 		return err
 	}
 
-	// Map to our output
-	if err := mapstructure.Decode(raw, config); err != nil {
+	// Map to our output, allowing durations such as "30s"
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
+		Result:     config,
+	})
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(raw); err != nil {
 		return err
 	}
 	return nil
 }
 
+// loadTemplate parses a template into the template cache
+func (c *Config) loadTemplate(path string) error {
+	if c.templates == nil {
+		c.templates = newTemplateCache(c.PartialsDir)
+	}
+	if _, err := c.templates.Load(path); err != nil {
+		return fmt.Errorf("invalid template '%s': %v", path, err)
+	}
+	return nil
+}
+
 // validateConfig is used to sanity check the configuration
 func validateConfig(conf *Config) (errs []error) {
 	// Check the template
-	if len(conf.Templates) == 0 {
+	if len(conf.Templates) == 0 && len(conf.Outputs) == 0 {
 		errs = append(errs, errors.New("missing template path"))
 	} else {
 		for _, t := range conf.Templates {
-			_, err := ioutil.ReadFile(t)
-			if err != nil {
-				errs = append(errs, fmt.Errorf("failed to read template '%s': %v", t, err))
+			if err := conf.loadTemplate(t); err != nil {
+				errs = append(errs, err)
 			}
 		}
 	}
 
-	if len(conf.Paths) == 0 && !conf.DryRun {
+	if len(conf.Paths) == 0 && len(conf.Outputs) == 0 && !conf.DryRun {
 		errs = append(errs, errors.New("missing configuration path"))
 	}
 
@@ -189,7 +483,34 @@ func validateConfig(conf *Config) (errs []error) {
 	}
 
 	if conf.ReloadCommand == "" && !conf.DryRun {
-		errs = append(errs, errors.New("missing reload command"))
+		if len(conf.Outputs) == 0 || len(conf.Templates) != 0 {
+			errs = append(errs, errors.New("missing reload command"))
+		}
+	}
+
+	// Check the per-template outputs
+	for _, o := range conf.Outputs {
+		if o.Template == "" {
+			errs = append(errs, errors.New("output missing template path"))
+			continue
+		}
+		if err := conf.loadTemplate(o.Template); err != nil {
+			errs = append(errs, err)
+		}
+		if o.Path == "" && !conf.DryRun {
+			errs = append(errs, fmt.Errorf("missing configuration path for template '%s'", o.Template))
+		}
+		if o.ReloadCommand == "" && conf.ReloadCommand == "" && !conf.DryRun {
+			errs = append(errs, fmt.Errorf("missing reload command for template '%s'", o.Template))
+		}
+		if o.Mode != "" {
+			if _, err := parseFileMode(o.Mode); err != nil {
+				errs = append(errs, fmt.Errorf("invalid mode for template '%s': %v", o.Template, err))
+			}
+		}
+		if (o.Quiet != nil && *o.Quiet < 0) || (o.MaxWait != nil && *o.MaxWait < 0) {
+			errs = append(errs, fmt.Errorf("Cannot specify a negative time interval for template '%s'", o.Template))
+		}
 	}
 
 	if len(conf.Backends) == 0 {
@@ -197,33 +518,152 @@ func validateConfig(conf *Config) (errs []error) {
 	}
 
 	for _, b := range conf.Backends {
-		parts := WatchRE.FindStringSubmatch(b)
-		if parts == nil || len(parts) != 6 {
-			errs = append(errs, fmt.Errorf("Backend '%s' could not be parsed", b))
+		wp, err := parseWatchPath(b)
+		if err != nil {
+			errs = append(errs, err)
 			continue
 		}
-		var port int
-		if parts[5] != "" {
-			p, err := strconv.ParseInt(strings.TrimPrefix(parts[5], ":"), 10, 64)
-			if err != nil {
-				errs = append(errs, fmt.Errorf("Backend '%s' port could not be parsed", b))
-				continue
+		conf.watches = append(conf.watches, wp)
+	}
+
+	// Backends are available to templates by name, alongside the
+	// other names in the template context
+	reserved := make(map[string]bool)
+	for _, wp := range conf.watches {
+		if (wp.Backend == contextBackends || wp.Backend == contextRender) && !reserved[wp.Backend] {
+			reserved[wp.Backend] = true
+			errs = append(errs, fmt.Errorf("backend name '%s' is reserved", wp.Backend))
+		}
+	}
+
+	// Check the query settings
+	if conf.Consistency == "" {
+		conf.Consistency = ConsistencyDefault
+	} else if err := checkConsistency(conf.Consistency); err != nil {
+		errs = append(errs, err)
+	}
+	if conf.MaxStale < 0 || conf.WaitTime < 0 || conf.QueryInterval < 0 {
+		errs = append(errs, errors.New("Cannot specify a negative time interval"))
+	}
+	for _, wp := range conf.watches {
+		if wp.WaitTime > maxWaitTime {
+			errs = append(errs, fmt.Errorf("wait time for backend '%s' exceeds %v", wp.Spec, maxWaitTime))
+		}
+	}
+	if conf.WaitTime > maxWaitTime {
+		errs = append(errs, fmt.Errorf("wait time exceeds %v", maxWaitTime))
+	}
+
+	// Check the retry intervals
+	if conf.RetryBase < 0 || conf.RetryMax < 0 || conf.RetryReset < 0 {
+		errs = append(errs, errors.New("Cannot specify a negative time interval"))
+	} else {
+		// Each default is derived from the other interval if that is
+		// given, so only setting both can conflict
+		if conf.RetryBase == 0 {
+			conf.RetryBase = failSleep
+			if conf.RetryMax != 0 && conf.RetryMax < conf.RetryBase {
+				conf.RetryBase = conf.RetryMax
 			}
-			port = int(p)
 		}
-		wp := &WatchPath{
-			Spec:       parts[0],
-			Backend:    parts[1],
-			Tag:        strings.TrimSuffix(parts[2], "."),
-			Service:    parts[3],
-			Datacenter: strings.TrimPrefix(parts[4], "@"),
-			Port:       port,
+		if conf.RetryMax == 0 {
+			conf.RetryMax = backoff(conf.RetryBase, maxFailures)
+		}
+		if conf.RetryMax < conf.RetryBase {
+			errs = append(errs, errors.New("maximum retry interval is less than the base interval"))
+		}
+	}
+
+	// Check the error policy
+	switch conf.ErrorPolicy {
+	case "":
+		conf.ErrorPolicy = PolicyWait
+	case PolicyWait, PolicyRender, PolicyHold:
+	default:
+		errs = append(errs, fmt.Errorf("invalid error policy '%s', must be one of %s, %s or %s",
+			conf.ErrorPolicy, PolicyWait, PolicyRender, PolicyHold))
+	}
+
+	// Check the sort order
+	switch conf.Sort {
+	case "":
+		conf.Sort = SortNode
+	case SortNode, SortID, SortAddress, SortConsul:
+	default:
+		errs = append(errs, fmt.Errorf("invalid sort '%s', must be one of %s, %s, %s or %s",
+			conf.Sort, SortNode, SortID, SortAddress, SortConsul))
+	}
+
+	// Check the guards
+	backends := make(map[string]bool)
+	for _, wp := range conf.watches {
+		backends[wp.Backend] = true
+	}
+	guards := append([]*GuardConfig{&GuardConfig{
+		MinServers:       conf.MinServers,
+		MaxRemovePercent: conf.MaxRemovePercent,
+	}}, conf.Guards...)
+	for idx, g := range guards {
+		if idx > 0 && !backends[g.Backend] {
+			errs = append(errs, fmt.Errorf("guard for unknown backend '%s'", g.Backend))
+		}
+		// Only a backend guard can disable a check
+		disabled := idx > 0 && g.MinServers == guardDisabled
+		if g.MinServers < 0 && !disabled {
+			errs = append(errs, errors.New("minimum servers cannot be negative"))
+		}
+		disabled = idx > 0 && g.MaxRemovePercent == guardDisabled
+		if (g.MaxRemovePercent < 0 && !disabled) || g.MaxRemovePercent > 100 {
+			errs = append(errs, errors.New("maximum percentage removed must be between 0 and 100"))
 		}
-		conf.watches = append(conf.watches, wp)
+	}
+
+	// Check the runtime backends
+	for _, spec := range conf.RuntimeBackends {
+		rb, err := parseRuntimeBackend(spec)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		conf.runtimeBackends = append(conf.runtimeBackends, rb)
+	}
+	if len(conf.RuntimeBackends) != 0 && conf.RuntimeSocket == "" {
+		errs = append(errs, errors.New("runtime backends require a runtime socket"))
+	}
+
+	// Resolve the ACL token
+	token, err := resolveToken(conf)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	conf.token = token
+
+	// Check the connection settings
+	if conf.Scheme != "" && conf.Scheme != "http" && conf.Scheme != "https" {
+		errs = append(errs, fmt.Errorf("invalid scheme '%s', must be http or https", conf.Scheme))
+	}
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		errs = append(errs, errors.New("client certificate and key must be provided together"))
+	} else if err := checkTLSConfig(conf); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Check the startup behaviour
+	switch conf.Startup {
+	case "":
+		conf.Startup = StartupWait
+	case StartupWait:
+	case StartupCache:
+		if conf.StateFile == "" {
+			errs = append(errs, errors.New("cache startup requires a state file"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid startup '%s', must be %s or %s",
+			conf.Startup, StartupWait, StartupCache))
 	}
 
 	// Ensure a non-negative time interval
-	if conf.Quiet < 0 || conf.MaxWait < 0 {
+	if conf.Quiet < 0 || conf.MaxWait < 0 || conf.StartupTimeout < 0 {
 		errs = append(errs, errors.New("Cannot specify a negative time interval"))
 	}
 
@@ -236,6 +676,27 @@ func validateConfig(conf *Config) (errs []error) {
 	return
 }
 
+// resolveToken returns the ACL token to use. A token given directly
+// takes precedence over a token file, which takes precedence over the
+// CONSUL_HTTP_TOKEN environment variable. Errors never include the token.
+func resolveToken(conf *Config) (string, error) {
+	if conf.Token != "" {
+		return conf.Token, nil
+	}
+	if conf.TokenFile != "" {
+		contents, err := ioutil.ReadFile(conf.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read token file '%s': %v", conf.TokenFile, err)
+		}
+		token := strings.TrimSpace(string(contents))
+		if token == "" {
+			return "", fmt.Errorf("token file '%s' is empty", conf.TokenFile)
+		}
+		return token, nil
+	}
+	return os.Getenv("CONSUL_HTTP_TOKEN"), nil
+}
+
 // waitForTerm waits until we receive a signal to exit
 func waitForTerm(conf *Config, stopCh, finishCh chan struct{}) int {
 	signalCh := make(chan os.Signal, 1)
@@ -283,7 +744,6 @@ func waitForTerm(conf *Config, stopCh, finishCh chan struct{}) int {
 			return 1
 		}
 	}
-	return 0
 }
 
 func usage() {
@@ -326,15 +786,70 @@ Usage: %s [options]
   populate the nodes in the 'app' backend. This can be used to merge
   multiple tags, datacenters, etc into a single backend.
 
+  Several tags can be required, and tags prefixed with '!' are excluded.
+  By default only passing instances are included, which can be changed
+  with the 'health' option to 'warning' or 'any'. The 'consistency',
+  'max_stale' and 'wait' options override the query settings:
+
+    app=release.!canary.webapp@east-aws:8000?health=warning&consistency=stale
+
+  The service address is used when registered, falling back to the node
+  address. Use the 'address' option to always use the node address:
+
+    app=webapp?address=node
+
 Options:
 
-  -addr=127.0.0.1:8500  Provides the HTTP address of a Consul agent.
+  -addr=127.0.0.1:8500  Provides the HTTP address of a Consul agent. Can be
+                        provided multiple times to fail over between agents.
+  -token=token          ACL token to use. Defaults to CONSUL_HTTP_TOKEN.
+  -token-file=path      File containing the ACL token, re-read on SIGHUP.
+  -scheme=http          Scheme of the Consul HTTP API, http or https.
+  -ca-file=path         CA certificate used to verify the Consul server.
+  -ca-path=path         Directory of CA certificates to verify the server.
+  -cert-file=path       Client certificate, for Consul verifying clients.
+  -key-file=path        Key of the client certificate.
+  -tls-server-name=name Server name to verify, if it differs from -addr.
+  -insecure-skip-verify Skip verification of the server certificate.
   -backend=spec         Backend specification. Can be provided multiple times.
+  -check=cmd            Command to validate a rendered config before it is
+                        installed. "{{path}}" is replaced by the file path.
   -dry                  Dry run. Emit config file to stdout.
   -f=path               Path to config file, overwrites CLI flags
   -in=path              Path to a template file.  Can be provided multiple times.
   -out=path             Path to output configuration file. Can be provided multiple times.
+  -partials=path        Directory of partials available to every template.
   -reload=cmd           Command to invoke to reload configuration
+  -runtime-socket=path  HAProxy stats socket used to update servers at runtime.
+  -runtime-backend=spec Backend to update using the runtime API instead of a
+                        reload. Can be provided multiple times.
+  -startup=wait         Startup behaviour while no agent is available, either
+                        'wait' or 'cache' to render from the state file.
+  -startup-timeout=0s   Maximum time to wait for an agent, or 0 for no limit.
+  -state-file=path      Path to save the last known good service data.
+  -consistency=default  Query consistency mode: 'default', 'stale' to allow any
+                        server to answer, or 'consistent'.
+  -max-stale=0s         Maximum staleness of a stale result before querying
+                        the leader instead, or 0 for no limit.
+  -wait=0s              Wait time of the blocking queries, or 0 for 60s.
+  -query-interval=1s    Minimum time between the queries of a watch.
+  -retry-base=5s        Retry interval after the first failure, doubling with
+                        each further failure. A random delay up to the
+                        interval is used.
+  -retry-max=80s        Maximum retry interval. Default 16x of -retry-base.
+  -retry-reset=0s       Time without failures before the retry interval is
+                        reset, or 0 to reset after any success.
+  -sort=node            Order of the servers of each backend: 'node', 'id',
+                        'address', or 'consul' to keep the order Consul
+                        returned them in.
+  -error-policy=wait    Rendering while watches fail: 'wait' for every backend
+                        to return servers, 'render' regardless, or 'hold'
+                        to render nothing while any watch is failing.
+  -min-servers=0        Refuse updates leaving a backend with fewer active servers.
+  -max-remove=0         Refuse updates removing more than this percentage of the
+                        active servers of a backend.
+  -guard-override       Apply updates even if they are refused by a guard.
+  -alert=cmd            Command to invoke when an update is refused.
   -quiet=0s             Period to wait without updates before trigger reload.
   -max-wait=0s          Maxium time to wait for quiet period. Default 4x of -quiet.
 `
@@ -1,44 +1,15 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
-func TestWatchRE(t *testing.T) {
-	type match struct {
-		inp   string
-		parts []string
-	}
-	inps := []match{
-		{"bar", nil},
-		{"bar=", nil},
-		{"=zip", nil},
-		{"app=bar", []string{"app", "", "bar", "", ""}},
-		{"app=tag.bar", []string{"app", "tag.", "bar", "", ""}},
-		{"app=bar@dc1", []string{"app", "", "bar", "@dc1", ""}},
-		{"app=bar:80", []string{"app", "", "bar", "", ":80"}},
-		{"app=bar@dc1:80", []string{"app", "", "bar", "@dc1", ":80"}},
-		{"app=tag.bar@dc1:80", []string{"app", "tag.", "bar", "@dc1", ":80"}},
-	}
-
-	for _, inp := range inps {
-		parts := WatchRE.FindStringSubmatch(inp.inp)
-		if len(parts) == 0 && len(inp.parts) != 0 {
-			t.Fatalf("unexpected fail: %s", inp.inp)
-		}
-		if len(parts) != 0 && len(inp.parts) == 0 {
-			t.Fatalf("unexpected parse: %s", inp.inp)
-		}
-		if len(parts) == 0 && len(inp.parts) == 0 {
-			continue
-		}
-		if !reflect.DeepEqual(parts[1:], inp.parts) {
-			t.Fatalf("bad: %v %v", parts[1:], inp.parts)
-		}
-	}
-}
-
 func TestReadConfig(t *testing.T) {
 	conf := &Config{}
 	err := readConfig("test-fixtures/config.json", conf)
@@ -96,6 +67,8 @@ func TestValidateConfig_Good(t *testing.T) {
 		Spec:    "app=foo",
 		Backend: "app",
 		Service: "foo",
+		Health:  HealthPassing,
+		Address: AddressService,
 	}
 	if !reflect.DeepEqual(wp1, conf.watches[0]) {
 		t.Fatalf("bad: %v", conf.watches[0])
@@ -103,8 +76,10 @@ func TestValidateConfig_Good(t *testing.T) {
 	wp2 := &WatchPath{
 		Spec:    "app=tag.foo",
 		Backend: "app",
-		Tag:     "tag",
+		Tags:    []string{"tag"},
 		Service: "foo",
+		Health:  HealthPassing,
+		Address: AddressService,
 	}
 	if !reflect.DeepEqual(wp2, conf.watches[1]) {
 		t.Fatalf("bad: %v", conf.watches[1])
@@ -112,10 +87,12 @@ func TestValidateConfig_Good(t *testing.T) {
 	wp3 := &WatchPath{
 		Spec:       "app=tag.foo@dc2:8000",
 		Backend:    "app",
-		Tag:        "tag",
+		Tags:       []string{"tag"},
 		Service:    "foo",
 		Datacenter: "dc2",
 		Port:       8000,
+		Health:     HealthPassing,
+		Address:    AddressService,
 	}
 	if !reflect.DeepEqual(wp3, conf.watches[2]) {
 		t.Fatalf("bad: %v", conf.watches[2])
@@ -129,3 +106,451 @@ func TestValidateConfig_Missing(t *testing.T) {
 		t.Fatalf("bad: %v", errs)
 	}
 }
+
+func TestReadConfig_Outputs(t *testing.T) {
+	conf := &Config{}
+	err := readConfig("test-fixtures/outputs.json", conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.Quiet != 5*time.Second {
+		t.Fatalf("bad: %v", conf.Quiet)
+	}
+	if len(conf.Outputs) != 3 {
+		t.Fatalf("bad: %v", conf.Outputs)
+	}
+	quiet, maxWait := time.Second, 10*time.Second
+	expect := &OutputConfig{
+		Template:      "test-fixtures/varnish.vcl",
+		Path:          "output.vcl",
+		ReloadCommand: "echo 'bar' > reload_out2",
+		CheckCommand:  "varnishd -C -f {{path}}",
+		Mode:          "0644",
+		Quiet:         &quiet,
+		MaxWait:       &maxWait,
+	}
+	if !reflect.DeepEqual(conf.Outputs[0], expect) {
+		t.Fatalf("bad: %#v", conf.Outputs[0])
+	}
+
+	errs := validateConfig(conf)
+	if len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+}
+
+func TestConfig_AllOutputs(t *testing.T) {
+	conf := &Config{}
+	err := readConfig("test-fixtures/outputs.json", conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if errs := validateConfig(conf); len(errs) > 0 {
+		t.Fatalf("err: %v", errs)
+	}
+
+	outputs := conf.allOutputs()
+	if len(outputs) != 4 {
+		t.Fatalf("bad: %v", outputs)
+	}
+
+	// The flat lists use the global settings
+	out := outputs[0]
+	if out.Template != "test-fixtures/simple.conf" || out.Path != "output.conf" {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out.ReloadCommand != "echo 'foo' > reload_out" {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out.quiet != 5*time.Second || out.maxWait != 20*time.Second {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out.mode != 0660 {
+		t.Fatalf("bad: %v", out.mode)
+	}
+
+	// Explicit settings are kept
+	out = outputs[1]
+	if out.ReloadCommand != "echo 'bar' > reload_out2" {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out.quiet != time.Second || out.maxWait != 10*time.Second {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out.mode != 0644 {
+		t.Fatalf("bad: %v", out.mode)
+	}
+
+	// Missing settings default to the global values
+	out = outputs[2]
+	if out.ReloadCommand != "echo 'foo' > reload_out" {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out.quiet != 5*time.Second || out.maxWait != 20*time.Second {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// A zero quiet period disables the global one
+	out = outputs[3]
+	if out.quiet != 0 || out.maxWait != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// The first output is updated using the runtime API by default
+	if outputs[0].Runtime {
+		t.Fatalf("bad: %#v", outputs[0])
+	}
+	conf.RuntimeSocket = "/var/run/haproxy.sock"
+	outputs = conf.allOutputs()
+	if !outputs[0].Runtime || outputs[1].Runtime {
+		t.Fatalf("bad: %#v", outputs)
+	}
+
+	// The configuration itself is not modified
+	if conf.Outputs[1].ReloadCommand != "" {
+		t.Fatalf("bad: %#v", conf.Outputs[1])
+	}
+}
+
+func TestValidateConfig_Outputs(t *testing.T) {
+	conf := &Config{
+		Backends: []string{"app=foo"},
+		Outputs: []*OutputConfig{
+			&OutputConfig{Template: "test-fixtures/simple.conf", Path: "out.conf"},
+			&OutputConfig{Path: "out.conf"},
+			&OutputConfig{Template: "test-fixtures/simple.conf", ReloadCommand: "true", Mode: "999"},
+		},
+	}
+	errs := validateConfig(conf)
+	if len(errs) != 4 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_RuntimeBackends(t *testing.T) {
+	conf := &Config{}
+	err := readConfig("test-fixtures/config.json", conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf.RuntimeBackends = []string{"app=be_app/srv", "=bad"}
+	errs := validateConfig(conf)
+	if len(errs) != 2 {
+		t.Fatalf("bad: %v", errs)
+	}
+	expect := []*RuntimeBackend{
+		&RuntimeBackend{Spec: "app=be_app/srv", Backend: "app", HAProxyBackend: "be_app", Prefix: "srv"},
+	}
+	if !reflect.DeepEqual(conf.runtimeBackends, expect) {
+		t.Fatalf("bad: %v", conf.runtimeBackends)
+	}
+}
+
+func TestResolveToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(emptyFile, []byte("\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	defer os.Setenv("CONSUL_HTTP_TOKEN", os.Getenv("CONSUL_HTTP_TOKEN"))
+	os.Setenv("CONSUL_HTTP_TOKEN", "env-token")
+
+	type match struct {
+		conf   *Config
+		expect string
+	}
+	inps := []match{
+		{&Config{Token: "flag-token", TokenFile: tokenFile}, "flag-token"},
+		{&Config{TokenFile: tokenFile}, "file-token"},
+		{&Config{}, "env-token"},
+	}
+	for _, inp := range inps {
+		token, err := resolveToken(inp.conf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if token != inp.expect {
+			t.Fatalf("bad: %v %v", token, inp.expect)
+		}
+	}
+
+	// An unreadable or empty token file is an error
+	for _, path := range []string{filepath.Join(dir, "missing"), emptyFile} {
+		if _, err := resolveToken(&Config{TokenFile: path}); err == nil {
+			t.Fatalf("expected error: %s", path)
+		}
+	}
+}
+
+func TestValidateConfig_TokenFile(t *testing.T) {
+	conf := &Config{}
+	err := readConfig("test-fixtures/config.json", conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf.TokenFile = "test-fixtures/missing-token"
+	errs := validateConfig(conf)
+	if len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+	if !strings.Contains(errs[0].Error(), "missing-token") {
+		t.Fatalf("bad: %v", errs[0])
+	}
+}
+
+func TestValidateConfig_TLS(t *testing.T) {
+	conf := &Config{}
+	err := readConfig("test-fixtures/config.json", conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf.Scheme = "ftp"
+	conf.CertFile = "test-fixtures/client.pem"
+	errs := validateConfig(conf)
+	if len(errs) != 2 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_Startup(t *testing.T) {
+	conf := &Config{}
+	err := readConfig("test-fixtures/config.json", conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if errs := validateConfig(conf); len(errs) != 0 || conf.Startup != StartupWait {
+		t.Fatalf("bad: %v %v", errs, conf.Startup)
+	}
+
+	conf.watches = nil
+	conf.Startup = StartupCache
+	if errs := validateConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+
+	conf.watches = nil
+	conf.Startup = "later"
+	conf.StartupTimeout = -time.Second
+	if errs := validateConfig(conf); len(errs) != 2 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestReadConfig_Guards(t *testing.T) {
+	conf := &Config{}
+	err := readConfig("test-fixtures/guards.json", conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.MinServers != 1 || conf.MaxRemovePercent != 50 || conf.AlertCommand != "logger guard tripped" {
+		t.Fatalf("bad: %#v", conf)
+	}
+	expect := []*GuardConfig{
+		&GuardConfig{Backend: "app", MinServers: 2},
+		&GuardConfig{Backend: "db", Override: true},
+	}
+	if !reflect.DeepEqual(conf.Guards, expect) {
+		t.Fatalf("bad: %v", conf.Guards)
+	}
+}
+
+func TestValidateConfig_Guards(t *testing.T) {
+	conf := &Config{}
+	err := readConfig("test-fixtures/config.json", conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf.MaxRemovePercent = 150
+	conf.Guards = []*GuardConfig{
+		&GuardConfig{Backend: "app", MinServers: 2},
+		&GuardConfig{Backend: "missing", MinServers: -2},
+	}
+	errs := validateConfig(conf)
+	if len(errs) != 3 {
+		t.Fatalf("bad: %v", errs)
+	}
+
+	// Only a backend guard can be disabled
+	conf.watches = nil
+	conf.MaxRemovePercent = guardDisabled
+	conf.Guards = []*GuardConfig{
+		&GuardConfig{Backend: "app", MinServers: guardDisabled, MaxRemovePercent: guardDisabled},
+	}
+	errs = validateConfig(conf)
+	if len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_ErrorPolicy(t *testing.T) {
+	conf := &Config{}
+	err := readConfig("test-fixtures/config.json", conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if errs := validateConfig(conf); len(errs) != 0 || conf.ErrorPolicy != PolicyWait {
+		t.Fatalf("bad: %v %v", errs, conf.ErrorPolicy)
+	}
+
+	conf.watches = nil
+	conf.ErrorPolicy = "ignore"
+	if errs := validateConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_Retry(t *testing.T) {
+	conf := &Config{}
+	err := readConfig("test-fixtures/config.json", conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if errs := validateConfig(conf); len(errs) != 0 {
+		t.Fatalf("bad: %v", errs)
+	}
+	if conf.RetryBase != 5*time.Second || conf.RetryMax != 80*time.Second {
+		t.Fatalf("bad: %v %v", conf.RetryBase, conf.RetryMax)
+	}
+
+	type match struct {
+		base, max, reset time.Duration
+		errs             int
+	}
+	inps := []match{
+		{time.Second, time.Minute, time.Minute, 0},
+		{2 * time.Minute, 0, 0, 0},
+		{0, time.Second, 0, 0},
+		{time.Minute, time.Second, 0, 1},
+		{-time.Second, 0, 0, 1},
+		{0, 0, -time.Second, 1},
+	}
+	for _, inp := range inps {
+		conf.watches = nil
+		conf.RetryBase = inp.base
+		conf.RetryMax = inp.max
+		conf.RetryReset = inp.reset
+		if errs := validateConfig(conf); len(errs) != inp.errs {
+			t.Fatalf("bad: %v %v", inp, errs)
+		}
+	}
+
+	// The maximum defaults to 16 times the base
+	conf.watches = nil
+	conf.RetryBase = 2 * time.Minute
+	conf.RetryMax = 0
+	conf.RetryReset = 0
+	if errs := validateConfig(conf); len(errs) != 0 || conf.RetryMax != 32*time.Minute {
+		t.Fatalf("bad: %v %v", errs, conf.RetryMax)
+	}
+}
+
+func TestValidateConfig_Template(t *testing.T) {
+	f, err := ioutil.TempFile("", "template")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("backend app{{range .app}")
+	f.Close()
+
+	conf := &Config{}
+	if err := readConfig("test-fixtures/config.json", conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if errs := validateConfig(conf); len(errs) != 0 || conf.templates == nil {
+		t.Fatalf("bad: %v", errs)
+	}
+
+	conf.watches = nil
+	conf.Templates = append(conf.Templates, f.Name())
+	conf.Paths = append(conf.Paths, "out")
+	errs := validateConfig(conf)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "Failed to parse the template") {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_Partials(t *testing.T) {
+	f, err := ioutil.TempFile("", "template")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{{template "backend" .}}{{template "frontend" .}}`)
+	f.Close()
+
+	conf := &Config{}
+	if err := readConfig("test-fixtures/config.json", conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf.PartialsDir = "test-fixtures/partials"
+	conf.Templates = append(conf.Templates, "test-fixtures/partials.conf")
+	conf.Paths = append(conf.Paths, "out")
+	if errs := validateConfig(conf); len(errs) != 0 {
+		t.Fatalf("bad: %v", errs)
+	}
+
+	// A missing partial is reported
+	conf.watches = nil
+	conf.templates = nil
+	conf.Templates = append(conf.Templates, f.Name())
+	conf.Paths = append(conf.Paths, "out2")
+	errs := validateConfig(conf)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "partial 'frontend' is not defined") {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_ReservedBackend(t *testing.T) {
+	conf := &Config{}
+	if err := readConfig("test-fixtures/config.json", conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf.Backends = append(conf.Backends, "Backends=web", "Backends=web@dc2", "Render=web")
+	errs := validateConfig(conf)
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "backend name 'Backends' is reserved") {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_Sort(t *testing.T) {
+	conf := &Config{}
+	err := readConfig("test-fixtures/config.json", conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if errs := validateConfig(conf); len(errs) != 0 || conf.Sort != SortNode {
+		t.Fatalf("bad: %v %v", errs, conf.Sort)
+	}
+
+	conf.watches = nil
+	conf.Sort = "random"
+	if errs := validateConfig(conf); len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestValidateConfig_Query(t *testing.T) {
+	conf := &Config{}
+	err := readConfig("test-fixtures/config.json", conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf.Consistency = "eventual"
+	conf.WaitTime = time.Hour
+	conf.QueryInterval = -time.Second
+	conf.Backends = append(conf.Backends, "db=mysql?wait=20m")
+	errs := validateConfig(conf)
+	if len(errs) != 4 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
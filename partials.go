@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// maxIncludeDepth limits how deeply partials can include each other,
+// in case the name of an included partial is not a constant
+const maxIncludeDepth = 32
+
+// partialExt is the extension of the partials in the partials
+// directory. Other files can be embedded using the file function.
+const partialExt = ".tmpl"
+
+// partialFiles lists the partials in a directory by name,
+// skipping hidden files and directories
+func partialFiles(dir string) ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []os.FileInfo
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || filepath.Ext(info.Name()) != partialExt {
+			continue
+		}
+		out = append(out, info)
+	}
+	return out, nil
+}
+
+// partialName is the name a partial is used by,
+// which is its file name without the extension
+func partialName(file string) string {
+	return strings.TrimSuffix(file, partialExt)
+}
+
+// parsePartials parses each file in the directory as a template named
+// after the file, associated with the given template so that it and
+// the other partials can use it. Any templates defined in the partials
+// are available as well.
+func parsePartials(templ *template.Template, dir string) error {
+	files, err := partialFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := partialName(file.Name())
+		if templ.Lookup(name) != nil {
+			return fmt.Errorf("partial '%s' is defined more than once", name)
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		if _, err := templ.New(name).Parse(string(raw)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readTemplateFile reads a file embedded in a template. A
+// relative path is relative to the partials directory, if any.
+func readTemplateFile(partialsDir, path string) (string, error) {
+	if partialsDir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(partialsDir, path)
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file '%s': %v", path, err)
+	}
+	return string(raw), nil
+}
+
+// newIncludeFunc returns a function that renders a partial of the
+// template to a string, so the output can be used in a pipeline
+func newIncludeFunc(templ *template.Template) func(string, interface{}) (string, error) {
+	depth := 0
+	return func(name string, data interface{}) (string, error) {
+		if templ == nil {
+			return "", errors.New("include is not available")
+		}
+		if templ.Lookup(name) == nil {
+			return "", fmt.Errorf("partial '%s' is not defined", name)
+		}
+		if depth >= maxIncludeDepth {
+			return "", fmt.Errorf("partials are included more than %d deep", maxIncludeDepth)
+		}
+		depth++
+		defer func() { depth-- }()
+
+		var buf bytes.Buffer
+		if err := templ.ExecuteTemplate(&buf, name, data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+}
+
+// checkTemplate ensures that every partial used by a template and its
+// partials is defined, that no partial uses itself, directly or through
+// others, and that the files embedded with a constant path exist
+func checkTemplate(templ *template.Template, partialsDir string) error {
+	uses := make(map[string][]string)
+	includes := make(map[string][]string)
+	var names []string
+	for _, t := range templ.Templates() {
+		if t.Tree == nil || t.Tree.Root == nil {
+			continue
+		}
+		names = append(names, t.Name())
+
+		var fileErr error
+		walkNode(t.Tree.Root, func(node parse.Node) {
+			switch n := node.(type) {
+			case *parse.TemplateNode:
+				uses[t.Name()] = append(uses[t.Name()], n.Name)
+			case *parse.CommandNode:
+				if len(n.Args) < 2 {
+					return
+				}
+				ident, ok := n.Args[0].(*parse.IdentifierNode)
+				if !ok {
+					return
+				}
+				arg, ok := n.Args[1].(*parse.StringNode)
+				if !ok {
+					return
+				}
+				switch ident.Ident {
+				case "include":
+					uses[t.Name()] = append(uses[t.Name()], arg.Text)
+					includes[t.Name()] = append(includes[t.Name()], arg.Text)
+				case "file":
+					if _, err := readTemplateFile(partialsDir, arg.Text); err != nil && fileErr == nil {
+						fileErr = err
+					}
+				}
+			}
+		})
+		if fileErr != nil {
+			return fmt.Errorf("%s: %v", t.Name(), fileErr)
+		}
+		for _, name := range uses[t.Name()] {
+			if templ.Lookup(name) == nil {
+				return fmt.Errorf("%s: partial '%s' is not defined", t.Name(), name)
+			}
+		}
+	}
+
+	// Look for include cycles starting from the template, then the
+	// partials. Recursion using the template action is allowed, since
+	// it is usually guarded by a condition, and the template package
+	// limits its depth.
+	sort.Strings(names)
+	names = append([]string{templ.Name()}, names...)
+	done := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		for i, p := range path {
+			if p == name {
+				cycle := append(path[i:], name)
+				return fmt.Errorf("partials include each other: %s", strings.Join(cycle, " -> "))
+			}
+		}
+		if done[name] {
+			return nil
+		}
+		path = append(path[:len(path):len(path)], name)
+		for _, use := range includes[name] {
+			if err := visit(use, path); err != nil {
+				return err
+			}
+		}
+		done[name] = true
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkNode calls fn for a node of a template and every node within it
+func walkNode(node parse.Node, fn func(parse.Node)) {
+	fn(node)
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			walkNode(child, fn)
+		}
+	case *parse.ActionNode:
+		walkNode(n.Pipe, fn)
+	case *parse.IfNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.RangeNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.WithNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.TemplateNode:
+		if n.Pipe != nil {
+			walkNode(n.Pipe, fn)
+		}
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			walkNode(cmd, fn)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkNode(arg, fn)
+		}
+	case *parse.ChainNode:
+		walkNode(n.Node, fn)
+	}
+}
+
+// walkBranch walks the parts of an if, range or with action
+func walkBranch(n *parse.BranchNode, fn func(parse.Node)) {
+	walkNode(n.Pipe, fn)
+	walkNode(n.List, fn)
+	if n.ElseList != nil {
+		walkNode(n.ElseList, fn)
+	}
+}
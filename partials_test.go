@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildTemplate_Partials(t *testing.T) {
+	c := newTemplateCache("test-fixtures/partials")
+	out, err := buildTemplate(c, "test-fixtures/partials.conf", newTemplateContext(&backendData{}, testTemplateServers(), nil))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect, err := ioutil.ReadFile("test-fixtures/partials.conf.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expect) {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestParseTemplateFile_Partials(t *testing.T) {
+	type match struct {
+		templ    string
+		partials map[string]string
+		err      string
+	}
+	inps := []match{
+		{`{{template "a"}}`, map[string]string{"a.tmpl": `a`}, ""},
+		{`{{include "a" .}}`, map[string]string{"a.tmpl": `{{include "b" .}}`, "b.tmpl": `b`}, ""},
+		{`{{file "static.cfg"}}`, map[string]string{"static.cfg": `{{`}, ""},
+		{`{{template "missing"}}`, nil, "partial 'missing' is not defined"},
+		{`{{include "missing" .}}`, nil, "partial 'missing' is not defined"},
+		{`{{template "a"}}`, map[string]string{"a.tmpl": `{{if .}}{{template "missing"}}{{end}}`},
+			"a: partial 'missing' is not defined"},
+		{`{{file "missing.cfg"}}`, nil, "failed to read file"},
+		{`{{template "a" .}}`, map[string]string{"a.tmpl": `{{range .}}{{template "a" .}}{{end}}`}, ""},
+		{`{{include "a" .}}`, map[string]string{"a.tmpl": `{{include "a" .}}`},
+			"partials include each other: a -> a"},
+		{`{{template "a"}}`, map[string]string{"a.tmpl": `{{range .}}{{include "b" .}}{{end}}`,
+			"b.tmpl": `{{with .}}{{include "a" .}}{{end}}`},
+			"partials include each other: a -> b -> a"},
+		{`{{define "a"}}x{{end}}`, map[string]string{"a.tmpl": `a`}, "partial 'a' is defined more than once"},
+		{`x`, map[string]string{"a.tmpl": `{{end}}`}, "Failed to parse the partials"},
+	}
+	for _, inp := range inps {
+		dir, err := ioutil.TempDir("", "partials")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		for name, contents := range inp.partials {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		path := filepath.Join(dir, ".template")
+		if err := ioutil.WriteFile(path, []byte(inp.templ), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		_, err = parseTemplateFile(path, dir)
+		if inp.err == "" && err != nil {
+			t.Fatalf("bad: %s %v", inp.templ, err)
+		}
+		if inp.err != "" && (err == nil || !strings.Contains(err.Error(), inp.err)) {
+			t.Fatalf("bad: %s %v", inp.templ, err)
+		}
+	}
+}
+
+func TestIncludeFunc_Depth(t *testing.T) {
+	// A cycle through a name that is not a constant
+	// is only caught when rendering
+	dir, err := ioutil.TempDir("", "partials")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.tmpl"), []byte(`{{include .name .}}`), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	path := filepath.Join(dir, ".template")
+	if err := ioutil.WriteFile(path, []byte(`{{include "a" (dict "name" "a")}}`), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, err = buildTemplate(newTemplateCache(dir), path, newTemplateContext(&backendData{}, nil, nil))
+	if err == nil || !strings.Contains(err.Error(), "included more than 32 deep") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestTemplateCache_Partials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partials")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".template")
+	partial := filepath.Join(dir, "a.tmpl")
+	writeTemplate(t, path, `{{template "a"}}`, -time.Minute)
+	writeTemplate(t, partial, `one`, -time.Minute)
+
+	c := newTemplateCache(dir)
+	if changed, err := c.Load(path); err != nil || !changed {
+		t.Fatalf("bad: %v %v", changed, err)
+	}
+
+	// A change to a partial parses the template again
+	writeTemplate(t, partial, `two`, -30*time.Second)
+	if changed, err := c.Load(path); err != nil || !changed {
+		t.Fatalf("bad: %v %v", changed, err)
+	}
+	out, err := buildTemplate(c, path, newTemplateContext(&backendData{}, nil, nil))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "two" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// As does a new partial, which may break the template
+	writeTemplate(t, filepath.Join(dir, "b.tmpl"), `{{template "missing"}}`, -20*time.Second)
+	if changed, err := c.Load(path); err != nil || changed {
+		t.Fatalf("bad: %v %v", changed, err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// retrier computes the delay before retrying after consecutive
+// failures. The delay grows exponentially from the base up to the
+// max, and full jitter picks a random delay up to that limit so that
+// many instances do not retry in lockstep.
+type retrier struct {
+	// Base is the limit of the delay after the first failure
+	Base time.Duration
+
+	// Max is the largest the limit of the delay can grow
+	Max time.Duration
+
+	// Reset is how long after the last failure a success must
+	// happen to reset the backoff. Zero resets on any success.
+	Reset time.Duration
+
+	// random returns a random number in [0, n), and is
+	// replaced in tests
+	random func(n int64) int64
+
+	failures    int
+	lastFailure time.Time
+}
+
+// newRetrier creates a retrier using the configured intervals
+func newRetrier(conf *Config) *retrier {
+	r := &retrier{
+		Base:   conf.RetryBase,
+		Max:    conf.RetryMax,
+		Reset:  conf.RetryReset,
+		random: lockedInt63n,
+	}
+	if r.Base <= 0 {
+		r.Base = failSleep
+	}
+	if r.Max <= 0 {
+		r.Max = backoff(r.Base, maxFailures)
+	}
+	return r
+}
+
+// Failure records a failure and returns how long to wait
+// before retrying
+func (r *retrier) Failure(now time.Time) time.Duration {
+	// Stop counting once the limit reaches the max, so the
+	// backoff cannot overflow
+	if limit := backoff(r.Base, r.failures); r.failures == 0 ||
+		(limit < r.Max && limit <= math.MaxInt64/2) {
+		r.failures++
+	}
+	r.lastFailure = now
+
+	n := int64(r.limit())
+	if n < math.MaxInt64 {
+		n++
+	}
+	return time.Duration(r.random(n))
+}
+
+// Success records a success, resetting the backoff
+// according to the reset policy
+func (r *retrier) Success(now time.Time) {
+	if r.failures == 0 {
+		return
+	}
+	if r.Reset == 0 || now.Sub(r.lastFailure) >= r.Reset {
+		r.failures = 0
+	}
+}
+
+// limit is the longest delay for the current number of failures
+func (r *retrier) limit() time.Duration {
+	limit := backoff(r.Base, r.failures)
+	if limit > r.Max {
+		limit = r.Max
+	}
+	return limit
+}
+
+// randLock protects the shared random source
+var (
+	randLock   sync.Mutex
+	randSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// lockedInt63n returns a random number in [0, n) from
+// the shared source
+func lockedInt63n(n int64) int64 {
+	randLock.Lock()
+	defer randLock.Unlock()
+	return randSource.Int63n(n)
+}
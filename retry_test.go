@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func testRetrier(seed int64) *retrier {
+	src := rand.New(rand.NewSource(seed))
+	return &retrier{
+		Base:   time.Second,
+		Max:    16 * time.Second,
+		random: src.Int63n,
+	}
+}
+
+func TestRetrier_Limit(t *testing.T) {
+	r := testRetrier(1)
+	expect := []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 16 * time.Second, 16 * time.Second,
+	}
+	for i, limit := range expect {
+		if wait := r.Failure(time.Now()); wait < 0 || wait > limit {
+			t.Fatalf("bad: %d %v", i, wait)
+		}
+		if r.limit() != limit {
+			t.Fatalf("bad: %d %v", i, r.limit())
+		}
+	}
+}
+
+func TestRetrier_Overflow(t *testing.T) {
+	r := testRetrier(1)
+	r.Max = time.Duration(1<<63 - 1)
+	for i := 0; i < 1000; i++ {
+		if wait := r.Failure(time.Now()); wait < 0 {
+			t.Fatalf("bad: %d %v", i, wait)
+		}
+	}
+	if r.limit() <= 0 {
+		t.Fatalf("bad: %v", r.limit())
+	}
+}
+
+func TestRetrier_Distribution(t *testing.T) {
+	r := testRetrier(42)
+	for i := 0; i < 10; i++ {
+		r.Failure(time.Now())
+	}
+
+	const samples = 10000
+	const buckets = 8
+	counts := make([]int, buckets)
+	var total time.Duration
+	for i := 0; i < samples; i++ {
+		wait := r.Failure(time.Now())
+		if wait < 0 || wait > r.Max {
+			t.Fatalf("bad: %v", wait)
+		}
+		total += wait
+		counts[int(int64(wait)*buckets/int64(r.Max+1))]++
+	}
+
+	// Full jitter is uniform over [0, max], so the mean is max/2
+	mean := total / samples
+	if mean < 7*time.Second || mean > 9*time.Second {
+		t.Fatalf("bad: %v", mean)
+	}
+
+	// Each bucket should hold roughly an equal share
+	expect := samples / buckets
+	for i, count := range counts {
+		if count < expect*8/10 || count > expect*12/10 {
+			t.Fatalf("bad: %d %v", i, counts)
+		}
+	}
+}
+
+func TestRetrier_Jitter(t *testing.T) {
+	// Instances failing together should not retry in lockstep
+	seen := make(map[time.Duration]struct{})
+	for seed := int64(0); seed < 10; seed++ {
+		r := testRetrier(seed)
+		r.Failure(time.Now())
+		seen[r.Failure(time.Now())] = struct{}{}
+	}
+	if len(seen) < 9 {
+		t.Fatalf("bad: %v", seen)
+	}
+}
+
+func TestRetrier_Reset(t *testing.T) {
+	now := time.Now()
+	r := testRetrier(1)
+	r.Failure(now)
+	r.Failure(now)
+	r.Success(now)
+	if r.failures != 0 {
+		t.Fatalf("bad: %d", r.failures)
+	}
+
+	r.Reset = time.Minute
+	r.Failure(now)
+	r.Failure(now)
+	r.Success(now.Add(30 * time.Second))
+	if r.failures != 2 {
+		t.Fatalf("bad: %d", r.failures)
+	}
+	r.Failure(now.Add(40 * time.Second))
+	r.Success(now.Add(90 * time.Second))
+	if r.failures != 3 {
+		t.Fatalf("bad: %d", r.failures)
+	}
+	r.Success(now.Add(100 * time.Second))
+	if r.failures != 0 {
+		t.Fatalf("bad: %d", r.failures)
+	}
+}
+
+func TestNewRetrier(t *testing.T) {
+	r := newRetrier(&Config{})
+	if r.Base != failSleep || r.Max != 80*time.Second || r.Reset != 0 {
+		t.Fatalf("bad: %#v", r)
+	}
+	r = newRetrier(&Config{RetryBase: time.Second, RetryMax: time.Minute, RetryReset: time.Hour})
+	if r.Base != time.Second || r.Max != time.Minute || r.Reset != time.Hour {
+		t.Fatalf("bad: %#v", r)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// runtimeTimeout limits how long a single Runtime API
+	// command may take
+	runtimeTimeout = 5 * time.Second
+)
+
+// errSlotsExhausted is returned when a backend has more servers
+// than there are server-template slots available
+var errSlotsExhausted = errors.New("not enough server slots")
+
+// RuntimeBackend maps a backend to the HAProxy backend and
+// server-template slots it is applied to using the Runtime API
+type RuntimeBackend struct {
+	Spec    string
+	Backend string
+
+	// HAProxyBackend is the name of the backend in HAProxy
+	HAProxyBackend string
+
+	// Prefix is the server-template prefix, slots are
+	// named with the prefix followed by a number
+	Prefix string
+}
+
+// parseRuntimeBackend parses a runtime backend specification.
+// This looks like "backend=haproxy_backend/prefix", where the HAProxy
+// backend defaults to the backend name and the prefix defaults to
+// the HAProxy backend name.
+func parseRuntimeBackend(spec string) (*RuntimeBackend, error) {
+	rb := &RuntimeBackend{Spec: spec}
+	rb.Backend = spec
+	if idx := strings.Index(spec, "="); idx != -1 {
+		rb.Backend = spec[:idx]
+		rb.HAProxyBackend = spec[idx+1:]
+	}
+	if idx := strings.Index(rb.HAProxyBackend, "/"); idx != -1 {
+		rb.Prefix = rb.HAProxyBackend[idx+1:]
+		rb.HAProxyBackend = rb.HAProxyBackend[:idx]
+	}
+	if rb.HAProxyBackend == "" {
+		rb.HAProxyBackend = rb.Backend
+	}
+	if rb.Prefix == "" {
+		rb.Prefix = rb.HAProxyBackend
+	}
+	if rb.Backend == "" || strings.ContainsAny(rb.HAProxyBackend+rb.Prefix, " /=") {
+		return nil, fmt.Errorf("Runtime backend '%s' could not be parsed", spec)
+	}
+	return rb, nil
+}
+
+// runtimeClient is used to issue commands to the HAProxy
+// Runtime API using a stats socket
+type runtimeClient struct {
+	// Address is a unix socket path, or host:port for a TCP socket
+	Address string
+}
+
+// execute runs a single command and returns the response
+func (c *runtimeClient) execute(command string) (string, error) {
+	network := "unix"
+	if !strings.Contains(c.Address, "/") && strings.Contains(c.Address, ":") {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, c.Address, runtimeTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(runtimeTimeout))
+
+	// HAProxy closes the connection after responding
+	if _, err := fmt.Fprintf(conn, "%s\n", command); err != nil {
+		return "", err
+	}
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(resp)), nil
+}
+
+// runtimeSlot is a single server-template slot
+type runtimeSlot struct {
+	Name  string
+	Addr  string
+	Port  int
+	Maint bool
+}
+
+// serverSlots returns the server-template slots of a backend
+func (c *runtimeClient) serverSlots(rb *RuntimeBackend) ([]*runtimeSlot, error) {
+	resp, err := c.execute("show servers state " + rb.HAProxyBackend)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first line is the format version followed by a header,
+	// anything else indicates an error such as a missing backend
+	scanner := bufio.NewScanner(strings.NewReader(resp))
+	if !scanner.Scan() || scanner.Text() != "1" {
+		return nil, fmt.Errorf("unexpected response: %s", resp)
+	}
+
+	var slots []*runtimeSlot
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Fields are: be_id be_name srv_id srv_name srv_addr
+		// srv_op_state srv_admin_state ... srv_fqdn srv_port ...
+		fields := strings.Fields(line)
+		if len(fields) < 19 {
+			return nil, fmt.Errorf("unexpected server state: %s", line)
+		}
+		if !isSlotName(fields[3], rb.Prefix) {
+			continue
+		}
+		admin, _ := strconv.Atoi(fields[6])
+		port, _ := strconv.Atoi(fields[18])
+		slots = append(slots, &runtimeSlot{
+			Name:  fields[3],
+			Addr:  fields[4],
+			Port:  port,
+			Maint: admin&0x1 != 0,
+		})
+	}
+	return slots, nil
+}
+
+// isSlotName checks if a server name is a server-template slot
+func isSlotName(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	_, err := strconv.Atoi(name[len(prefix):])
+	return err == nil
+}
+
+// setServer points a slot at a server and marks it ready
+func (c *runtimeClient) setServer(rb *RuntimeBackend, slot string, se *ServerEntry) error {
+	name := rb.HAProxyBackend + "/" + slot
+	resp, err := c.execute(fmt.Sprintf("set server %s addr %s port %d", name, se.IP, se.Port))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(resp, "changed") && !strings.Contains(resp, "no need to change") {
+		return fmt.Errorf("failed to set address of %s: %s", name, resp)
+	}
+	return c.setState(rb, slot, "ready")
+}
+
+// setState changes the administrative state of a slot
+func (c *runtimeClient) setState(rb *RuntimeBackend, slot, state string) error {
+	name := rb.HAProxyBackend + "/" + slot
+	resp, err := c.execute(fmt.Sprintf("set server %s state %s", name, state))
+	if err != nil {
+		return err
+	}
+	if resp != "" {
+		return fmt.Errorf("failed to set state of %s: %s", name, resp)
+	}
+	return nil
+}
+
+// syncBackend updates the slots of a backend to match the servers.
+// Servers keep the slot they already occupy to avoid disrupting
+// connections, new servers take a free slot and slots that are no
+// longer needed, or whose server is critical or in maintenance, are
+// put into maintenance.
+func (c *runtimeClient) syncBackend(rb *RuntimeBackend, servers []*ServerEntry) error {
+	slots, err := c.serverSlots(rb)
+	if err != nil {
+		return err
+	}
+
+	// Servers that should not receive traffic do not need a slot.
+	// Slot addresses can only be set to an IP, so hostnames require
+	// a reload.
+	var enabled []*ServerEntry
+	for _, se := range servers {
+		if se.Disabled() {
+			continue
+		}
+		if se.IP == nil {
+			return fmt.Errorf("server %s_%s has no IP address: '%s'", se.Node, se.ID, se.Address)
+		}
+		enabled = append(enabled, se)
+	}
+	servers = enabled
+	if len(servers) > len(slots) {
+		return errSlotsExhausted
+	}
+
+	// Find the servers which already have a slot
+	assigned := make(map[*runtimeSlot]*ServerEntry)
+	var unassigned []*ServerEntry
+	for _, se := range servers {
+		found := false
+		for _, slot := range slots {
+			if _, ok := assigned[slot]; ok || slot.Maint {
+				continue
+			}
+			if slot.Addr == se.IP.String() && slot.Port == se.Port {
+				assigned[slot] = se
+				found = true
+				break
+			}
+		}
+		if !found {
+			unassigned = append(unassigned, se)
+		}
+	}
+
+	// Place the remaining servers and disable the unused slots
+	for _, slot := range slots {
+		if _, ok := assigned[slot]; ok {
+			continue
+		}
+		if len(unassigned) > 0 {
+			if err := c.setServer(rb, slot.Name, unassigned[0]); err != nil {
+				return err
+			}
+			unassigned = unassigned[1:]
+			continue
+		}
+		if !slot.Maint {
+			if err := c.setState(rb, slot.Name, "maint"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyRuntime attempts to apply a change using the Runtime API
+// instead of a reload. This is only possible if every backend that
+// changed since the last reload is managed using the Runtime API and
+// has enough slots for its servers. Returns if the change was applied.
+func applyRuntime(conf *Config, data *backendData) bool {
+	if conf.RuntimeSocket == "" || conf.DryRun || data.reloadedServers == nil {
+		return false
+	}
+	backendServers, tripped := guardServers(conf, data, aggregateServers(conf, data))
+
+	// Any other change requires a reload
+	runtimeBackends := make(map[string]*RuntimeBackend)
+	for _, rb := range conf.runtimeBackends {
+		runtimeBackends[rb.Backend] = rb
+	}
+	if len(backendServers) != len(data.reloadedServers) {
+		return false
+	}
+	for backend, entries := range backendServers {
+		old, ok := data.reloadedServers[backend]
+		if !ok {
+			return false
+		}
+		if _, ok := runtimeBackends[backend]; !ok && !reflect.DeepEqual(old, entries) {
+			return false
+		}
+	}
+
+	// Update each of the slots
+	client := &runtimeClient{Address: conf.RuntimeSocket}
+	servers := formatOutput(backendServers)
+	for _, rb := range conf.runtimeBackends {
+		if err := client.syncBackend(rb, servers[rb.Backend]); err != nil {
+			log.Printf("[WARN] Failed to update %s using the runtime API, reloading: %v",
+				rb.HAProxyBackend, err)
+			return false
+		}
+	}
+	log.Printf("[INFO] Updated servers using the runtime API")
+	data.reloadedServers = backendServers
+	data.guardedServers = backendServers
+	if !tripped {
+		persistState(conf, newSavedState(conf, data))
+	}
+	return true
+}
+
+// includesRuntime checks if the outputs include the HAProxy
+// configuration that is updated using the Runtime API
+func includesRuntime(outputs []*OutputConfig) bool {
+	for _, out := range outputs {
+		if out.Runtime {
+			return true
+		}
+	}
+	return false
+}
+
+// syncRuntime is used to populate the slots after a reload
+func syncRuntime(conf *Config, servers map[string][]*WatchEntry) {
+	if conf.RuntimeSocket == "" || conf.DryRun {
+		return
+	}
+	client := &runtimeClient{Address: conf.RuntimeSocket}
+	formatted := formatOutput(servers)
+	for _, rb := range conf.runtimeBackends {
+		if err := client.syncBackend(rb, formatted[rb.Backend]); err != nil {
+			log.Printf("[ERR] Failed to update %s using the runtime API: %v",
+				rb.HAProxyBackend, err)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// fakeHAProxy is a stand-in for the HAProxy Runtime API,
+// listening on a unix socket
+type fakeHAProxy struct {
+	sync.Mutex
+	dir      string
+	path     string
+	listener net.Listener
+	backends map[string][]*runtimeSlot
+	commands []string
+}
+
+func newFakeHAProxy(t *testing.T, backends map[string][]*runtimeSlot) *fakeHAProxy {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	path := filepath.Join(dir, "haproxy.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("err: %v", err)
+	}
+	f := &fakeHAProxy{
+		dir:      dir,
+		path:     path,
+		listener: l,
+		backends: backends,
+	}
+	go f.serve()
+	return f
+}
+
+func (f *fakeHAProxy) Close() {
+	f.listener.Close()
+	os.RemoveAll(f.dir)
+}
+
+func (f *fakeHAProxy) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		fmt.Fprint(conn, f.handle(strings.TrimSpace(line)))
+		conn.Close()
+	}
+}
+
+// setCommands returns the "set" commands which were issued
+func (f *fakeHAProxy) setCommands() []string {
+	f.Lock()
+	defer f.Unlock()
+	var out []string
+	for _, c := range f.commands {
+		if strings.HasPrefix(c, "set ") {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (f *fakeHAProxy) handle(command string) string {
+	f.Lock()
+	defer f.Unlock()
+	f.commands = append(f.commands, command)
+	args := strings.Fields(command)
+
+	switch {
+	case strings.HasPrefix(command, "show servers state "):
+		slots, ok := f.backends[args[3]]
+		if !ok {
+			return "Can't find backend.\n"
+		}
+		out := "1\n# be_id be_name srv_id srv_name srv_addr srv_op_state srv_admin_state " +
+			"srv_uweight srv_iweight srv_time_since_last_change srv_check_status " +
+			"srv_check_result srv_check_health srv_check_state srv_agent_state " +
+			"bk_f_forced_id srv_f_forced_id srv_fqdn srv_port srvrecord\n"
+		for idx, s := range slots {
+			admin := 0
+			if s.Maint {
+				admin = 1
+			}
+			out += fmt.Sprintf("3 %s %d %s %s 2 %d 1 1 0 6 3 4 6 0 0 0 - %d -\n",
+				args[3], idx+1, s.Name, s.Addr, admin, s.Port)
+		}
+		return out + "\n"
+
+	case len(args) >= 4 && args[0] == "set" && args[1] == "server":
+		parts := strings.SplitN(args[2], "/", 2)
+		var slot *runtimeSlot
+		for _, s := range f.backends[parts[0]] {
+			if len(parts) == 2 && s.Name == parts[1] {
+				slot = s
+			}
+		}
+		if slot == nil {
+			return "No such server.\n"
+		}
+		switch {
+		case args[3] == "addr" && len(args) == 7:
+			port, _ := strconv.Atoi(args[6])
+			if slot.Addr == args[4] && slot.Port == port {
+				return "no need to change the addr, port.\n"
+			}
+			resp := fmt.Sprintf("IP changed from '%s' to '%s', port changed from '%d' to '%d' by 'stats socket command'\n",
+				slot.Addr, args[4], slot.Port, port)
+			slot.Addr = args[4]
+			slot.Port = port
+			return resp
+		case args[3] == "state" && args[4] == "ready":
+			slot.Maint = false
+			return "\n"
+		case args[3] == "state" && args[4] == "maint":
+			slot.Maint = true
+			return "\n"
+		}
+	}
+	return "Unknown command.\n"
+}
+
+func testSlots(n int) []*runtimeSlot {
+	slots := make([]*runtimeSlot, n)
+	for i := range slots {
+		slots[i] = &runtimeSlot{
+			Name:  fmt.Sprintf("app%d", i+1),
+			Addr:  "127.0.0.1",
+			Port:  80,
+			Maint: true,
+		}
+	}
+	return slots
+}
+
+func TestParseRuntimeBackend(t *testing.T) {
+	type match struct {
+		inp    string
+		expect *RuntimeBackend
+	}
+	inps := []match{
+		{"app", &RuntimeBackend{Spec: "app", Backend: "app", HAProxyBackend: "app", Prefix: "app"}},
+		{"app=be_app", &RuntimeBackend{Spec: "app=be_app", Backend: "app", HAProxyBackend: "be_app", Prefix: "be_app"}},
+		{"app=be_app/srv", &RuntimeBackend{Spec: "app=be_app/srv", Backend: "app", HAProxyBackend: "be_app", Prefix: "srv"}},
+		{"app=/srv", &RuntimeBackend{Spec: "app=/srv", Backend: "app", HAProxyBackend: "app", Prefix: "srv"}},
+		{"=app", nil},
+		{"app=be app", nil},
+	}
+	for _, inp := range inps {
+		rb, err := parseRuntimeBackend(inp.inp)
+		if inp.expect == nil {
+			if err == nil {
+				t.Fatalf("expected error: %s", inp.inp)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reflect.DeepEqual(rb, inp.expect) {
+			t.Fatalf("bad: %#v %#v", rb, inp.expect)
+		}
+	}
+}
+
+func TestRuntimeClient_ServerSlots(t *testing.T) {
+	slots := testSlots(2)
+	slots[0].Maint = false
+	slots = append(slots, &runtimeSlot{Name: "apple", Addr: "127.0.0.9", Port: 80})
+	f := newFakeHAProxy(t, map[string][]*runtimeSlot{"app": slots})
+	defer f.Close()
+
+	client := &runtimeClient{Address: f.path}
+	rb, _ := parseRuntimeBackend("app")
+	out, err := client.serverSlots(rb)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := []*runtimeSlot{
+		&runtimeSlot{Name: "app1", Addr: "127.0.0.1", Port: 80},
+		&runtimeSlot{Name: "app2", Addr: "127.0.0.1", Port: 80, Maint: true},
+	}
+	if !reflect.DeepEqual(out, expect) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// A missing backend is an error
+	rb, _ = parseRuntimeBackend("db")
+	if _, err := client.serverSlots(rb); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRuntimeClient_SyncBackend(t *testing.T) {
+	slots := testSlots(3)
+	slots[0].Addr = "127.0.0.1"
+	slots[0].Port = 8000
+	slots[0].Maint = false
+	slots[1].Addr = "127.0.0.2"
+	slots[1].Port = 8000
+	slots[1].Maint = false
+	f := newFakeHAProxy(t, map[string][]*runtimeSlot{"app": slots})
+	defer f.Close()
+
+	client := &runtimeClient{Address: f.path}
+	rb, _ := parseRuntimeBackend("app")
+	servers := []*ServerEntry{
+		&ServerEntry{IP: net.ParseIP("127.0.0.3"), Port: 8000},
+		&ServerEntry{IP: net.ParseIP("127.0.0.1"), Port: 8000},
+	}
+	if err := client.syncBackend(rb, servers); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The existing server keeps its slot, the removed server's
+	// slot is reused and the unused slot is left alone
+	expect := []string{
+		"set server app/app2 addr 127.0.0.3 port 8000",
+		"set server app/app2 state ready",
+	}
+	if cmds := f.setCommands(); !reflect.DeepEqual(cmds, expect) {
+		t.Fatalf("bad: %v", cmds)
+	}
+
+	// Removing a server puts its slot into maintenance
+	if err := client.syncBackend(rb, servers[:1]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !slots[0].Maint || slots[1].Maint || !slots[2].Maint {
+		t.Fatalf("bad: %v %v %v", slots[0], slots[1], slots[2])
+	}
+}
+
+func TestRuntimeClient_SyncBackend_Exhausted(t *testing.T) {
+	f := newFakeHAProxy(t, map[string][]*runtimeSlot{"app": testSlots(1)})
+	defer f.Close()
+
+	client := &runtimeClient{Address: f.path}
+	rb, _ := parseRuntimeBackend("app")
+	servers := []*ServerEntry{
+		&ServerEntry{IP: net.ParseIP("127.0.0.1"), Port: 8000},
+		&ServerEntry{IP: net.ParseIP("127.0.0.2"), Port: 8000},
+	}
+	if err := client.syncBackend(rb, servers); err != errSlotsExhausted {
+		t.Fatalf("err: %v", err)
+	}
+	if cmds := f.setCommands(); len(cmds) != 0 {
+		t.Fatalf("bad: %v", cmds)
+	}
+}
+
+func TestRuntimeClient_SyncBackend_Hostname(t *testing.T) {
+	f := newFakeHAProxy(t, map[string][]*runtimeSlot{"app": testSlots(2)})
+	defer f.Close()
+
+	client := &runtimeClient{Address: f.path}
+	rb, _ := parseRuntimeBackend("app")
+	servers := []*ServerEntry{
+		&ServerEntry{IP: net.ParseIP("127.0.0.1"), Address: "127.0.0.1", Port: 8000},
+		&ServerEntry{Address: "web.example.com", Port: 8000},
+	}
+	if err := client.syncBackend(rb, servers); err == nil {
+		t.Fatalf("expected error")
+	}
+	if cmds := f.setCommands(); len(cmds) != 0 {
+		t.Fatalf("bad: %v", cmds)
+	}
+}
+
+func TestApplyRuntime(t *testing.T) {
+	f := newFakeHAProxy(t, map[string][]*runtimeSlot{"app": testSlots(2)})
+	defer f.Close()
+
+	en1 := &WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}}
+	en2 := &WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+		Service: &consulapi.AgentService{ID: "app", Port: 8000},
+	}}
+	en3 := &WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
+		Service: &consulapi.AgentService{ID: "db", Port: 5000},
+	}}
+	wp1 := &WatchPath{Backend: "app"}
+	wp2 := &WatchPath{Backend: "db"}
+	d := &backendData{
+		Servers: map[*WatchPath][]*WatchEntry{
+			wp1: []*WatchEntry{en1},
+			wp2: []*WatchEntry{en3},
+		},
+		Backends: map[string][]*WatchPath{
+			"app": []*WatchPath{wp1},
+			"db":  []*WatchPath{wp2},
+		},
+	}
+	rb, _ := parseRuntimeBackend("app")
+	conf := &Config{
+		RuntimeSocket:   f.path,
+		runtimeBackends: []*RuntimeBackend{rb},
+		watches:         []*WatchPath{wp1, wp2},
+		StateFile:       filepath.Join(f.dir, "state.json"),
+	}
+
+	// Nothing has been reloaded yet
+	if applyRuntime(conf, d) {
+		t.Fatalf("unexpected apply")
+	}
+
+	// A change to a runtime backend is applied
+	d.reloadedServers = aggregateServers(conf, d)
+	d.Servers[wp1] = []*WatchEntry{en1, en2}
+	if !applyRuntime(conf, d) {
+		t.Fatalf("expected apply")
+	}
+	expect := []string{
+		"set server app/app1 addr 127.0.0.1 port 8000",
+		"set server app/app1 state ready",
+		"set server app/app2 addr 127.0.0.2 port 8000",
+		"set server app/app2 state ready",
+	}
+	if cmds := f.setCommands(); !reflect.DeepEqual(cmds, expect) {
+		t.Fatalf("bad: %v", cmds)
+	}
+
+	// The applied servers are saved
+	state, err := loadState(conf.StateFile)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(state.Watches) != 2 || len(state.Watches[0].Entries) != 2 {
+		t.Fatalf("bad: %v", state.Watches)
+	}
+
+	// Exhausting the slots requires a reload
+	d.Servers[wp1] = []*WatchEntry{en1, en2, en3}
+	if applyRuntime(conf, d) {
+		t.Fatalf("unexpected apply")
+	}
+
+	// A change to any other backend requires a reload
+	d.Servers[wp1] = []*WatchEntry{en1}
+	d.Servers[wp2] = nil
+	if applyRuntime(conf, d) {
+		t.Fatalf("unexpected apply")
+	}
+}
+
+func TestMaybeRefresh_Runtime(t *testing.T) {
+	f := newFakeHAProxy(t, map[string][]*runtimeSlot{"app": testSlots(4)})
+	defer f.Close()
+
+	d, watches := testRefreshData()
+	path := filepath.Join(f.dir, "haproxy.cfg")
+	path2 := filepath.Join(f.dir, "varnish.vcl")
+	reloadOut := filepath.Join(f.dir, "reload_out")
+	reloadOut2 := filepath.Join(f.dir, "reload_out2")
+	rb, _ := parseRuntimeBackend("app")
+	conf := &Config{
+		RuntimeSocket:   f.path,
+		runtimeBackends: []*RuntimeBackend{rb},
+		watches:         watches,
+		Outputs: []*OutputConfig{
+			&OutputConfig{
+				Template:      "test-fixtures/simple.conf",
+				Path:          path,
+				ReloadCommand: "echo 'foo' >> " + reloadOut,
+			},
+			&OutputConfig{
+				Template:      "test-fixtures/varnish.vcl",
+				Path:          path2,
+				ReloadCommand: "echo 'bar' >> " + reloadOut2,
+			},
+		},
+	}
+	if maybeRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	haproxy, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A runtime change only skips rendering the HAProxy configuration
+	d.Servers[watches[1]] = nil
+	if maybeRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != string(haproxy) {
+		t.Fatalf("bad: %s", out)
+	}
+	out, err = ioutil.ReadFile(reloadOut)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "foo\n" {
+		t.Fatalf("bad: %s", out)
+	}
+	out, err = ioutil.ReadFile(reloadOut2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "bar\nbar\n" {
+		t.Fatalf("bad: %s", out)
+	}
+	out, err = ioutil.ReadFile(path2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if strings.Contains(string(out), "node3") {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestMaybeRefresh_RuntimeRestored(t *testing.T) {
+	f := newFakeHAProxy(t, map[string][]*runtimeSlot{"app": testSlots(4)})
+	defer f.Close()
+
+	d, watches := testRefreshData()
+	path := filepath.Join(f.dir, "haproxy.cfg")
+	rb, _ := parseRuntimeBackend("app")
+	conf := &Config{
+		RuntimeSocket:   f.path,
+		runtimeBackends: []*RuntimeBackend{rb},
+		watches:         watches,
+		Templates:       []string{"test-fixtures/simple.conf"},
+		Paths:           []string{path},
+		ReloadCommand:   "true",
+		StateFile:       filepath.Join(f.dir, "state.json"),
+	}
+	persistState(conf, newSavedState(conf, d))
+
+	// After a restart, the first update is rendered and reloaded
+	// rather than applied using the runtime API
+	restored := &backendData{
+		Servers:  make(map[*WatchPath][]*WatchEntry),
+		Backends: d.Backends,
+	}
+	if !restoreState(conf, restored) {
+		t.Fatalf("expected restore")
+	}
+	restored.Servers[watches[1]] = nil
+	if maybeRefresh(conf, restored) {
+		t.Fatalf("unexpected exit")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if restored.reloadedServers == nil {
+		t.Fatalf("expected reloaded servers")
+	}
+}
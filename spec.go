@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// These are the health states of a check or an instance. A watch path
+// includes instances up to and including the given state, where
+// HealthAny includes all instances regardless of health.
+const (
+	HealthPassing  = "passing"
+	HealthWarning  = "warning"
+	HealthCritical = "critical"
+	HealthMaint    = "maintenance"
+	HealthAny      = "any"
+)
+
+// These select the address used for an instance. AddressService uses
+// the service address when one is registered, falling back to the node
+// address, while AddressNode always uses the node address.
+const (
+	AddressService = "service"
+	AddressNode    = "node"
+)
+
+// These are the consistency modes of a query. ConsistencyStale lets
+// any server answer, ConsistencyConsistent verifies the leader before
+// answering, and ConsistencyDefault uses the leader without verifying.
+const (
+	ConsistencyDefault    = "default"
+	ConsistencyStale      = "stale"
+	ConsistencyConsistent = "consistent"
+)
+
+// WatchPath represents a path we need to watch
+type WatchPath struct {
+	Spec       string
+	Backend    string
+	Service    string
+	Datacenter string
+	Port       int
+
+	// Tags must all be present on an instance
+	Tags []string
+
+	// ExcludeTags must not be present on an instance
+	ExcludeTags []string
+
+	// Health is the worst health state to include, one of
+	// HealthPassing, HealthWarning or HealthAny
+	Health string
+
+	// Address is the address to use for instances, one of
+	// AddressService or AddressNode
+	Address string
+
+	// Consistency, MaxStale and WaitTime override the global query
+	// settings if provided
+	Consistency string
+	MaxStale    time.Duration
+	WaitTime    time.Duration
+}
+
+// parseWatchPath is used to parse a backend specification. The spec
+// looks like "backend=tag.!other.service@datacenter:port?health=warning&address=node".
+// The supported options are health, address, consistency, max_stale and wait.
+// The tags, datacenter, port and options are optional, so it can also
+// be provided as "backend=service". Tags prefixed with "!" are excluded.
+func parseWatchPath(spec string) (*WatchPath, error) {
+	fail := func(format string, args ...interface{}) (*WatchPath, error) {
+		return nil, fmt.Errorf("Backend '%s' could not be parsed: %s",
+			spec, fmt.Sprintf(format, args...))
+	}
+	wp := &WatchPath{Spec: spec, Health: HealthPassing, Address: AddressService}
+
+	// Split the backend name from the selector
+	idx := strings.Index(spec, "=")
+	if idx == -1 {
+		return fail("expected 'backend=service'")
+	}
+	wp.Backend = spec[:idx]
+	rest := spec[idx+1:]
+	if wp.Backend == "" {
+		return fail("missing backend name")
+	}
+	if strings.ContainsAny(wp.Backend, " \t") {
+		return fail("backend name contains whitespace")
+	}
+
+	// Parse any options
+	if idx := strings.Index(rest, "?"); idx != -1 {
+		if err := parseWatchOptions(wp, rest[idx+1:]); err != nil {
+			return fail("%v", err)
+		}
+		rest = rest[:idx]
+	}
+
+	// Parse the port
+	if idx := strings.LastIndex(rest, ":"); idx != -1 {
+		port, err := strconv.ParseUint(rest[idx+1:], 10, 16)
+		if err != nil || port == 0 {
+			return fail("invalid port '%s'", rest[idx+1:])
+		}
+		wp.Port = int(port)
+		rest = rest[:idx]
+	}
+
+	// Parse the datacenter
+	if idx := strings.LastIndex(rest, "@"); idx != -1 {
+		wp.Datacenter = rest[idx+1:]
+		rest = rest[:idx]
+		if wp.Datacenter == "" {
+			return fail("missing datacenter after '@'")
+		}
+		if strings.ContainsAny(wp.Datacenter, ".@") {
+			return fail("invalid datacenter '%s'", wp.Datacenter)
+		}
+	}
+
+	// The last segment is the service, the rest are tags
+	parts := strings.Split(rest, ".")
+	wp.Service = parts[len(parts)-1]
+	if wp.Service == "" {
+		return fail("missing service name")
+	}
+	if strings.ContainsAny(wp.Service, "!@: \t") {
+		return fail("invalid service name '%s'", wp.Service)
+	}
+	for _, tag := range parts[:len(parts)-1] {
+		exclude := strings.HasPrefix(tag, "!")
+		tag = strings.TrimPrefix(tag, "!")
+		if tag == "" {
+			return fail("empty tag")
+		}
+		if strings.ContainsAny(tag, "!@: \t") {
+			return fail("invalid tag '%s'", tag)
+		}
+		if exclude {
+			wp.ExcludeTags = append(wp.ExcludeTags, tag)
+		} else {
+			wp.Tags = append(wp.Tags, tag)
+		}
+	}
+	return wp, nil
+}
+
+// parseWatchOptions parses the "key=value&key=value" options
+// of a backend specification
+func parseWatchOptions(wp *WatchPath, raw string) error {
+	for _, opt := range strings.Split(raw, "&") {
+		idx := strings.Index(opt, "=")
+		if idx == -1 {
+			return fmt.Errorf("option '%s' must be given as 'key=value'", opt)
+		}
+		key, value := opt[:idx], opt[idx+1:]
+		switch key {
+		case "health":
+			switch value {
+			case HealthPassing, HealthWarning, HealthAny:
+				wp.Health = value
+			default:
+				return fmt.Errorf("invalid health '%s', must be one of %s, %s or %s",
+					value, HealthPassing, HealthWarning, HealthAny)
+			}
+		case "consistency":
+			if err := checkConsistency(value); err != nil {
+				return err
+			}
+			wp.Consistency = value
+		case "max_stale", "wait":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid duration '%s' for '%s'", value, key)
+			}
+			if key == "wait" {
+				wp.WaitTime = d
+			} else {
+				wp.MaxStale = d
+			}
+		case "address":
+			switch value {
+			case AddressService, AddressNode:
+				wp.Address = value
+			default:
+				return fmt.Errorf("invalid address '%s', must be %s or %s",
+					value, AddressService, AddressNode)
+			}
+		default:
+			return fmt.Errorf("unknown option '%s'", key)
+		}
+	}
+	return nil
+}
+
+// checkConsistency ensures a consistency mode is valid
+func checkConsistency(mode string) error {
+	switch mode {
+	case ConsistencyDefault, ConsistencyStale, ConsistencyConsistent:
+		return nil
+	}
+	return fmt.Errorf("invalid consistency '%s', must be one of %s, %s or %s",
+		mode, ConsistencyDefault, ConsistencyStale, ConsistencyConsistent)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWatchPath(t *testing.T) {
+	type match struct {
+		inp    string
+		expect *WatchPath
+	}
+	inps := []match{
+		{"app=bar", &WatchPath{Backend: "app", Service: "bar"}},
+		{"app=tag.bar", &WatchPath{Backend: "app", Service: "bar", Tags: []string{"tag"}}},
+		{"app=bar@dc1", &WatchPath{Backend: "app", Service: "bar", Datacenter: "dc1"}},
+		{"app=bar:80", &WatchPath{Backend: "app", Service: "bar", Port: 80}},
+		{"app=bar@dc1:80", &WatchPath{Backend: "app", Service: "bar", Datacenter: "dc1", Port: 80}},
+		{"app=tag.bar@dc1:80", &WatchPath{Backend: "app", Service: "bar", Tags: []string{"tag"},
+			Datacenter: "dc1", Port: 80}},
+		{"app=a.b.bar", &WatchPath{Backend: "app", Service: "bar", Tags: []string{"a", "b"}}},
+		{"app=a.!canary.bar", &WatchPath{Backend: "app", Service: "bar", Tags: []string{"a"},
+			ExcludeTags: []string{"canary"}}},
+		{"app=!canary.!beta.bar", &WatchPath{Backend: "app", Service: "bar",
+			ExcludeTags: []string{"canary", "beta"}}},
+		{"app=bar?health=warning", &WatchPath{Backend: "app", Service: "bar", Health: HealthWarning}},
+		{"app=a.bar@dc1:80?health=any", &WatchPath{Backend: "app", Service: "bar", Tags: []string{"a"},
+			Datacenter: "dc1", Port: 80, Health: HealthAny}},
+		{"app=bar?consistency=stale&max_stale=10s&wait=30s", &WatchPath{Backend: "app", Service: "bar",
+			Consistency: ConsistencyStale, MaxStale: 10 * time.Second, WaitTime: 30 * time.Second}},
+		{"app=bar?consistency=consistent", &WatchPath{Backend: "app", Service: "bar",
+			Consistency: ConsistencyConsistent}},
+		{"app=bar?address=node", &WatchPath{Backend: "app", Service: "bar", Address: AddressNode}},
+		{"app=bar?health=any&address=service", &WatchPath{Backend: "app", Service: "bar",
+			Health: HealthAny, Address: AddressService}},
+	}
+	for _, inp := range inps {
+		wp, err := parseWatchPath(inp.inp)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		inp.expect.Spec = inp.inp
+		if inp.expect.Health == "" {
+			inp.expect.Health = HealthPassing
+		}
+		if inp.expect.Address == "" {
+			inp.expect.Address = AddressService
+		}
+		if !reflect.DeepEqual(wp, inp.expect) {
+			t.Fatalf("bad: %#v %#v", wp, inp.expect)
+		}
+	}
+}
+
+func TestParseWatchPath_Invalid(t *testing.T) {
+	type match struct {
+		inp string
+		err string
+	}
+	inps := []match{
+		{"bar", "expected 'backend=service'"},
+		{"bar=", "missing service name"},
+		{"=zip", "missing backend name"},
+		{"my app=zip", "backend name contains whitespace"},
+		{"app=bar:http", "invalid port 'http'"},
+		{"app=bar:0", "invalid port '0'"},
+		{"app=bar:99999", "invalid port '99999'"},
+		{"app=bar@", "missing datacenter"},
+		{"app=bar@dc.1", "invalid datacenter 'dc.1'"},
+		{"app=tag.", "missing service name"},
+		{"app=a..bar", "empty tag"},
+		{"app=!.bar", "empty tag"},
+		{"app=a!b.bar", "invalid tag 'a!b'"},
+		{"app=!bar", "invalid service name '!bar'"},
+		{"app=bar?health", "option 'health' must be given as 'key=value'"},
+		{"app=bar?health=sick", "invalid health 'sick'"},
+		{"app=bar?address=wan", "invalid address 'wan'"},
+		{"app=bar?consistency=eventual", "invalid consistency 'eventual'"},
+		{"app=bar?max_stale=soon", "invalid duration 'soon' for 'max_stale'"},
+		{"app=bar?wait=-1s", "invalid duration '-1s' for 'wait'"},
+		{"app=bar?foo=bar", "unknown option 'foo'"},
+	}
+	for _, inp := range inps {
+		_, err := parseWatchPath(inp.inp)
+		if err == nil {
+			t.Fatalf("unexpected parse: %s", inp.inp)
+		}
+		if !strings.Contains(err.Error(), inp.err) {
+			t.Fatalf("bad: %s: %v", inp.inp, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// stateVersion is the version of the state file format
+const stateVersion = 1
+
+// savedState is the last known good service data. It is persisted
+// so that the configuration can be rendered without Consul.
+type savedState struct {
+	Version int
+	Watches []*savedWatch
+}
+
+// savedWatch holds the entries returned by a single watch path
+type savedWatch struct {
+	Spec    string
+	Entries []*WatchEntry
+}
+
+// newSavedState captures the entries of every watch that has returned
+func newSavedState(conf *Config, data *backendData) *savedState {
+	state := &savedState{Version: stateVersion}
+	data.Lock()
+	defer data.Unlock()
+	for _, watch := range conf.watches {
+		entries, ok := data.Servers[watch]
+		if !ok {
+			continue
+		}
+		state.Watches = append(state.Watches, &savedWatch{Spec: watch.Spec, Entries: entries})
+	}
+	return state
+}
+
+// saveState writes the state to path, unless it is unchanged
+func saveState(path string, state *savedState) error {
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if fileContentsEqual(path, raw) {
+		return nil
+	}
+	return writeFileAtomic(path, raw, 0600)
+}
+
+// loadState reads a state file written by saveState
+func loadState(path string) (*savedState, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &savedState{}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return nil, err
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported state version %d", state.Version)
+	}
+	return state, nil
+}
+
+// restore populates the servers of each watch found in the state,
+// returning the specs of any watches that are missing
+func (s *savedState) restore(conf *Config, data *backendData) (missing []string) {
+	used := make(map[*savedWatch]bool)
+	servers := make(map[*WatchPath][]*WatchEntry)
+	for idx, watch := range conf.watches {
+		var saved *savedWatch
+		for _, sw := range s.Watches {
+			if sw.Spec == watch.Spec && !used[sw] && validEntries(sw.Entries) {
+				saved = sw
+				break
+			}
+		}
+		if saved == nil {
+			missing = append(missing, watch.Spec)
+			continue
+		}
+		used[saved] = true
+
+		// The node names are prefixed using the current watch index
+		for _, entry := range saved.Entries {
+			entry.Watch = watch
+			entry.Node.Node = fmt.Sprintf("%d_%s", idx, entry.NodeName)
+		}
+		servers[watch] = saved.Entries
+	}
+
+	data.Lock()
+	defer data.Unlock()
+	for watch, entries := range servers {
+		data.Servers[watch] = entries
+	}
+	return
+}
+
+// validEntries checks the saved entries have the fields we use
+func validEntries(entries []*WatchEntry) bool {
+	for _, entry := range entries {
+		if entry.ServiceEntry == nil || entry.Node == nil || entry.Service == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// persistState saves the state if a state file is configured
+func persistState(conf *Config, state *savedState) {
+	if conf.StateFile == "" || conf.DryRun {
+		return
+	}
+	if err := saveState(conf.StateFile, state); err != nil {
+		log.Printf("[ERR] Failed to save state to %s: %v", conf.StateFile, err)
+	}
+}
+
+// restoreState populates the servers from the state file.
+// Returns if every watch was restored.
+func restoreState(conf *Config, data *backendData) bool {
+	state, err := loadState(conf.StateFile)
+	if os.IsNotExist(err) {
+		log.Printf("[INFO] No state found at %s", conf.StateFile)
+		return false
+	} else if err != nil {
+		log.Printf("[WARN] Failed to load state from %s: %v", conf.StateFile, err)
+		return false
+	}
+	missing := state.restore(conf, data)
+	for _, spec := range missing {
+		log.Printf("[WARN] No saved state for backend '%s'", spec)
+	}
+
+	// The restored servers are what was last applied, so the
+	// first update is guarded against them
+	data.guardedServers = aggregateServers(conf, data)
+	log.Printf("[INFO] Restored last known state from %s", conf.StateFile)
+	return len(missing) == 0
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSaveState_Restore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	d, watches := testRefreshData()
+	watches[0].Spec = "app=web"
+	watches[1].Spec = "app=web@dc2"
+	d.Servers[watches[0]][0].NodeName = "node1"
+	d.Servers[watches[1]][0].NodeName = "node3"
+	conf := &Config{watches: watches}
+	if err := saveState(path, newSavedState(conf, d)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Restore with the watches in a different order
+	wp1 := &WatchPath{Spec: "app=web@dc2", Backend: "app"}
+	wp2 := &WatchPath{Spec: "app=web", Backend: "app"}
+	conf = &Config{watches: []*WatchPath{wp1, wp2}}
+	restored := &backendData{Servers: make(map[*WatchPath][]*WatchEntry)}
+	if missing := state.restore(conf, restored); len(missing) != 0 {
+		t.Fatalf("bad: %v", missing)
+	}
+	en1 := restored.Servers[wp1]
+	en2 := restored.Servers[wp2]
+	if len(en1) != 1 || len(en2) != 1 {
+		t.Fatalf("bad: %v %v", en1, en2)
+	}
+	if en1[0].Node.Node != "0_node3" || en1[0].Watch != wp1 || en1[0].Node.Address != "127.0.0.3" {
+		t.Fatalf("bad: %#v", en1[0])
+	}
+	if en2[0].Node.Node != "1_node1" || en2[0].Watch != wp2 || en2[0].Service.Port != 8000 {
+		t.Fatalf("bad: %#v", en2[0])
+	}
+}
+
+func TestSavedState_Restore_Missing(t *testing.T) {
+	d, watches := testRefreshData()
+	watches[0].Spec = "app=web"
+	watches[1].Spec = "app=web@dc2"
+	state := newSavedState(&Config{watches: watches}, d)
+
+	// Missing watches are reported, the rest are restored
+	wp := &WatchPath{Spec: "db=mysql", Backend: "db"}
+	conf := &Config{watches: append(watches, wp)}
+	restored := &backendData{Servers: make(map[*WatchPath][]*WatchEntry)}
+	missing := state.restore(conf, restored)
+	if !reflect.DeepEqual(missing, []string{"db=mysql"}) {
+		t.Fatalf("bad: %v", missing)
+	}
+	if len(restored.Servers) != 2 {
+		t.Fatalf("bad: %v", restored.Servers)
+	}
+}
+
+func TestLoadState_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	if _, err := loadState(path); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"Version": 99}`), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := loadState(path); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestForceRefresh_StateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, watches := testRefreshData()
+	conf := &Config{
+		watches:       watches,
+		Templates:     []string{"test-fixtures/simple.conf"},
+		Paths:         []string{filepath.Join(dir, "haproxy.cfg")},
+		ReloadCommand: "true",
+		StateFile:     filepath.Join(dir, "state.json"),
+	}
+	if forceRefresh(conf, d, conf.allOutputs()) {
+		t.Fatalf("unexpected exit")
+	}
+
+	// The rendered servers are saved
+	state, err := loadState(conf.StateFile)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(state.Watches) != 2 {
+		t.Fatalf("bad: %v", state.Watches)
+	}
+
+	// A failed reload does not save the state
+	os.Remove(conf.StateFile)
+	d.Servers[watches[0]] = nil
+	conf.ReloadCommand = "false"
+	if forceRefresh(conf, d, conf.allOutputs()) {
+		t.Fatalf("unexpected exit")
+	}
+	if _, err := os.Stat(conf.StateFile); !os.IsNotExist(err) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, watches := testRefreshData()
+	watches[0].Spec = "app=web"
+	watches[1].Spec = "app=web@dc2"
+	conf := &Config{watches: watches, StateFile: filepath.Join(dir, "state.json")}
+
+	// Nothing has been saved yet
+	restored := &backendData{Servers: make(map[*WatchPath][]*WatchEntry)}
+	if restoreState(conf, restored) {
+		t.Fatalf("unexpected restore")
+	}
+
+	persistState(conf, newSavedState(conf, d))
+	restored.Backends = d.Backends
+	if !restoreState(conf, restored) {
+		t.Fatalf("expected restore")
+	}
+	if !allWatchesReturned(conf, restored) {
+		t.Fatalf("expected all watches")
+	}
+
+	// Updates are guarded against the restored servers
+	if len(restored.guardedServers["app"]) != 2 || restored.reloadedServers != nil {
+		t.Fatalf("bad: %v", restored.guardedServers)
+	}
+
+	// A new backend is restored partially
+	conf.watches = append(conf.watches, &WatchPath{Spec: "db=mysql", Backend: "db"})
+	restored = &backendData{Servers: make(map[*WatchPath][]*WatchEntry)}
+	if restoreState(conf, restored) {
+		t.Fatalf("unexpected complete restore")
+	}
+	if len(restored.Servers) != 2 {
+		t.Fatalf("bad: %v", restored.Servers)
+	}
+}
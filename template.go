@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// templatePollInterval controls how often the
+// templates and partials are checked for changes
+const templatePollInterval = 5 * time.Second
+
+// templateCache holds the parsed templates. A template is parsed again
+// only when its file or the partials change, and the last good parse is
+// kept if the new contents fail to parse.
+type templateCache struct {
+	sync.Mutex
+	templates map[string]*cachedTemplate
+
+	// partialsDir is the directory of partials
+	// available to every template
+	partialsDir string
+}
+
+// cachedTemplate is a parsed template and the
+// state of its files when they were read
+type cachedTemplate struct {
+	templ *template.Template
+	stamp string
+
+	// failed is set if the files failed to parse, so the
+	// error is only reported once for each change
+	failed bool
+}
+
+// newTemplateCache creates an empty template cache
+func newTemplateCache(partialsDir string) *templateCache {
+	return &templateCache{
+		templates:   make(map[string]*cachedTemplate),
+		partialsDir: partialsDir,
+	}
+}
+
+// Get returns the parsed template, parsing it again if the files
+// changed. A nil cache parses the file every time, without partials.
+func (c *templateCache) Get(path string) (*template.Template, error) {
+	if c == nil {
+		return parseTemplateFile(path, "")
+	}
+	if _, err := c.Load(path); err != nil {
+		return nil, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.templates[path].templ, nil
+}
+
+// Load parses the template if it is not cached or its files changed.
+// If the files cannot be read or parsed the last good parse is kept,
+// and an error is only returned if there is none. Returns if a new
+// parse was loaded.
+func (c *templateCache) Load(path string) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+	cached, ok := c.templates[path]
+
+	stamp, err := templateStamp(path, c.partialsDir)
+	if err != nil {
+		if ok {
+			return false, nil
+		}
+		return false, err
+	}
+	if ok && stamp == cached.stamp {
+		return false, nil
+	}
+
+	templ, err := parseTemplateFile(path, c.partialsDir)
+
+	// Wait for the next check if the files changed while they were
+	// read, in case they are still being written
+	if after, _ := templateStamp(path, c.partialsDir); after != stamp {
+		if ok {
+			return false, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("Template %s changed while being read", path)
+		}
+		return false, err
+	}
+
+	if err != nil {
+		if !ok {
+			return false, err
+		}
+		if !cached.failed {
+			log.Printf("[ERR] %v, using the last good version of %s", err, path)
+		}
+		cached.stamp = stamp
+		cached.failed = true
+		return false, nil
+	}
+	if ok {
+		log.Printf("[INFO] Reloaded template %s", path)
+	}
+	c.templates[path] = &cachedTemplate{
+		templ: templ,
+		stamp: stamp,
+	}
+	return true, nil
+}
+
+// templateStamp describes the modification time and size of a
+// template and the partials, so a change to any of them is seen
+func templateStamp(path, partialsDir string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read template: %v", err)
+	}
+	stamp := fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+	if partialsDir == "" {
+		return stamp, nil
+	}
+	partials, err := partialFiles(partialsDir)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read partials: %v", err)
+	}
+	for _, p := range partials {
+		stamp += fmt.Sprintf(" %s:%d:%d", p.Name(), p.ModTime().UnixNano(), p.Size())
+	}
+	return stamp, nil
+}
+
+// parseTemplateFile reads and parses a template, along with the
+// partials if a directory is given, and checks the references between
+// them. The functions are bound when the template is executed.
+func parseTemplateFile(path, partialsDir string) (*template.Template, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read template: %v", err)
+	}
+	funcs := templateFuncs(nil, nil, partialsDir)
+	templ, err := template.New(path).Funcs(funcs).Parse(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the template: %v", err)
+	}
+	if partialsDir != "" {
+		if err := parsePartials(templ, partialsDir); err != nil {
+			return nil, fmt.Errorf("Failed to parse the partials: %v", err)
+		}
+	}
+	if err := checkTemplate(templ, partialsDir); err != nil {
+		return nil, fmt.Errorf("Failed to parse the template: %v", err)
+	}
+	return templ, nil
+}
+
+// templateFuncs returns the functions available to templates. Functions
+// taking a list of servers take it last, so they can be used in pipelines
+// such as {{range .app | withTag "v2" | sortBy "address"}}. The include
+// function renders partials of the given template, and file reads files
+// relative to the partials directory.
+func templateFuncs(status map[string]string, templ *template.Template,
+	partialsDir string) template.FuncMap {
+	return template.FuncMap{
+		"status": func(backend string) string {
+			return status[backend]
+		},
+
+		// Partials
+		"include": newIncludeFunc(templ),
+		"file": func(path string) (string, error) {
+			return readTemplateFile(partialsDir, path)
+		},
+		"dict": dict,
+
+		// Servers
+		"sortBy":            sortServers,
+		"withTag":           withTag,
+		"withoutTag":        withoutTag,
+		"groupByTag":        groupByTag,
+		"groupByDatacenter": groupByDatacenter,
+		"unique":            unique,
+
+		// Strings
+		"lower":        strings.ToLower,
+		"upper":        strings.ToUpper,
+		"replace":      replace,
+		"regexReplace": regexReplace,
+		"join":         join,
+		"split":        split,
+		"haproxyName":  haproxyName,
+
+		// Math
+		"add":      add,
+		"subtract": subtract,
+		"multiply": multiply,
+		"divide":   divide,
+	}
+}
+
+// serverLess compares two servers by a sort key
+type serverLess func(a, b *ServerEntry) bool
+
+// serverSortKeys are the keys servers can be sorted by
+var serverSortKeys = map[string]serverLess{
+	SortNode: func(a, b *ServerEntry) bool {
+		return a.NodeName < b.NodeName
+	},
+	SortID: func(a, b *ServerEntry) bool {
+		return a.ID < b.ID
+	},
+	SortAddress: func(a, b *ServerEntry) bool {
+		// Compare IP addresses numerically, and
+		// hostnames after them alphabetically
+		switch {
+		case a.IP != nil && b.IP != nil:
+			if c := bytes.Compare(a.IP.To16(), b.IP.To16()); c != 0 {
+				return c < 0
+			}
+		case a.IP != nil || b.IP != nil:
+			return a.IP != nil
+		case a.Address != b.Address:
+			return a.Address < b.Address
+		}
+		return a.Port < b.Port
+	},
+}
+
+// lessServers compares two servers by the sort key. Ties are broken
+// by the node and service ID so the order does not depend on the order
+// Consul returned them in.
+func lessServers(less serverLess, a, b *ServerEntry) bool {
+	if less(a, b) {
+		return true
+	}
+	if less(b, a) {
+		return false
+	}
+	if a.Node != b.Node {
+		return a.Node < b.Node
+	}
+	return a.ID < b.ID
+}
+
+// sortServers returns a copy of the servers sorted
+// by the key, one of node, id or address
+func sortServers(key string, servers []*ServerEntry) ([]*ServerEntry, error) {
+	less, ok := serverSortKeys[key]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort key '%s'", key)
+	}
+	out := make([]*ServerEntry, len(servers))
+	copy(out, servers)
+	sort.SliceStable(out, func(i, j int) bool {
+		return lessServers(less, out[i], out[j])
+	})
+	return out, nil
+}
+
+// sortEntries sorts the entries of a backend in the configured
+// order, defaulting to SortNode. SortConsul leaves them as they are.
+func sortEntries(order string, entries []*WatchEntry) {
+	if order == "" {
+		order = SortNode
+	}
+	less, ok := serverSortKeys[order]
+	if !ok {
+		return
+	}
+	servers := make(map[*WatchEntry]*ServerEntry, len(entries))
+	for _, entry := range entries {
+		servers[entry] = newServerEntry(entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return lessServers(less, servers[entries[i]], servers[entries[j]])
+	})
+}
+
+// withTag returns the servers that have the tag
+func withTag(tag string, servers []*ServerEntry) []*ServerEntry {
+	var out []*ServerEntry
+	for _, s := range servers {
+		if hasTags(s.Tags, []string{tag}, true) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// withoutTag returns the servers that do not have the tag
+func withoutTag(tag string, servers []*ServerEntry) []*ServerEntry {
+	var out []*ServerEntry
+	for _, s := range servers {
+		if !hasTags(s.Tags, []string{tag}, true) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// groupByTag groups the servers by each of their tags.
+// Servers without tags are left out.
+func groupByTag(servers []*ServerEntry) map[string][]*ServerEntry {
+	out := make(map[string][]*ServerEntry)
+	for _, s := range servers {
+		for _, tag := range unique(s.Tags).([]string) {
+			out[tag] = append(out[tag], s)
+		}
+	}
+	return out
+}
+
+// groupByDatacenter groups the servers by their datacenter
+func groupByDatacenter(servers []*ServerEntry) map[string][]*ServerEntry {
+	out := make(map[string][]*ServerEntry)
+	for _, s := range servers {
+		out[s.Datacenter] = append(out[s.Datacenter], s)
+	}
+	return out
+}
+
+// unique removes duplicates from a list of strings, or servers with
+// the same address and port, keeping the first of each
+func unique(list interface{}) interface{} {
+	switch l := list.(type) {
+	case []string:
+		out := []string{}
+		seen := make(map[string]struct{})
+		for _, s := range l {
+			if _, ok := seen[s]; !ok {
+				seen[s] = struct{}{}
+				out = append(out, s)
+			}
+		}
+		return out
+	case []*ServerEntry:
+		out := []*ServerEntry{}
+		seen := make(map[string]struct{})
+		for _, s := range l {
+			key := fmt.Sprintf("%s:%d", s.Address, s.Port)
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		return list
+	}
+}
+
+// dict builds a map from pairs of keys and values, so
+// several values can be passed to a partial
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("dict requires pairs of keys and values")
+	}
+	out := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict key %v is not a string", pairs[i])
+		}
+		out[key] = pairs[i+1]
+	}
+	return out, nil
+}
+
+// replace replaces every instance of old with new in s
+func replace(old, new, s string) string {
+	return strings.Replace(s, old, new, -1)
+}
+
+// regexReplace replaces the matches of the pattern in s, expanding
+// $1 style references in the replacement
+func regexReplace(pattern, repl, s string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+	}
+	return re.ReplaceAllString(s, repl), nil
+}
+
+// join joins a list of strings with the separator
+func join(sep string, list []string) string {
+	return strings.Join(list, sep)
+}
+
+// split splits a string around each instance of the separator
+func split(sep, s string) []string {
+	return strings.Split(s, sep)
+}
+
+// haproxyName makes a string safe to use as an HAProxy name, which
+// may only contain letters, digits, '-', '_', '.' and ':'. Any other
+// character is replaced by '_'.
+func haproxyName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == ':':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// add returns the sum of the values
+func add(a, b int) int {
+	return a + b
+}
+
+// subtract returns b subtracted from a
+func subtract(a, b int) int {
+	return a - b
+}
+
+// multiply returns the product of the values
+func multiply(a, b int) int {
+	return a * b
+}
+
+// divide returns a divided by b, rounded down
+func divide(a, b int) (int, error) {
+	if b == 0 {
+		return 0, fmt.Errorf("division of %d by zero", a)
+	}
+	return a / b, nil
+}
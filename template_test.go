@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// testTemplateServers returns servers with a mix of
+// tags, datacenters and weights for the template tests
+func testTemplateServers() map[string][]*WatchEntry {
+	entry := func(node, addr, dc, id string, port, weight int, tags ...string) *WatchEntry {
+		e := testWatchEntry("0_"+node, addr, id, port)
+		e.NodeName = node
+		e.Node.Datacenter = dc
+		e.Service.Service = "app"
+		e.Service.Tags = tags
+		e.Service.Weights = consulapi.AgentWeights{Passing: weight, Warning: 1}
+		return e
+	}
+	return map[string][]*WatchEntry{
+		"app": []*WatchEntry{
+			entry("web-3.east", "10.0.0.10", "EAST", "app.3", 8000, 1, "v1"),
+			entry("web-1.east", "10.0.0.9", "EAST", "app.1", 8000, 2, "v2", "canary"),
+			entry("web#2", "10.0.0.9", "WEST", "app.2", 8001, 1, "v2"),
+			entry("web-4", "10.0.0.10", "WEST", "app.4", 8000, 3),
+		},
+	}
+}
+
+func TestBuildTemplate_Funcs(t *testing.T) {
+	out, err := buildTemplate(nil, "test-fixtures/funcs.conf", newTemplateContext(&backendData{}, testTemplateServers(), nil))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect, err := ioutil.ReadFile("test-fixtures/funcs.conf.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expect) {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestBuildTemplate_FuncErrors(t *testing.T) {
+	type match struct {
+		templ string
+		err   string
+	}
+	inps := []match{
+		{`{{sortBy "port" .app}}`, "unknown sort key 'port'"},
+		{`{{divide 1 0}}`, "division of 1 by zero"},
+		{`{{regexReplace "(" "" "a"}}`, "invalid pattern '('"},
+	}
+	for _, inp := range inps {
+		f, err := ioutil.TempFile("", "template")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		f.WriteString(inp.templ)
+		f.Close()
+		defer os.Remove(f.Name())
+
+		_, err = buildTemplate(nil, f.Name(), newTemplateContext(&backendData{}, testTemplateServers(), nil))
+		if err == nil || !strings.Contains(err.Error(), inp.err) {
+			t.Fatalf("bad: %s %v", inp.templ, err)
+		}
+	}
+}
+
+func TestSortServers(t *testing.T) {
+	servers := []*ServerEntry{
+		&ServerEntry{Node: "b", ID: "2", Address: "web.example.com", Port: 80},
+		&ServerEntry{Node: "a", ID: "3", Address: "10.0.0.10", IP: net.ParseIP("10.0.0.10"), Port: 80},
+		&ServerEntry{Node: "c", ID: "1", Address: "10.0.0.9", IP: net.ParseIP("10.0.0.9"), Port: 81},
+		&ServerEntry{Node: "a", ID: "1", Address: "10.0.0.9", IP: net.ParseIP("10.0.0.9"), Port: 80},
+	}
+	type match struct {
+		key    string
+		expect []string
+	}
+	inps := []match{
+		{"node", []string{"a/1", "a/3", "b/2", "c/1"}},
+		{"id", []string{"a/1", "c/1", "b/2", "a/3"}},
+		{"address", []string{"a/1", "c/1", "a/3", "b/2"}},
+	}
+	for _, inp := range inps {
+		out, err := sortServers(inp.key, servers)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var names []string
+		for _, s := range out {
+			names = append(names, s.Node+"/"+s.ID)
+		}
+		if !reflect.DeepEqual(names, inp.expect) {
+			t.Fatalf("bad: %s %v", inp.key, names)
+		}
+	}
+
+	// The input is not modified
+	if servers[0].Node != "b" {
+		t.Fatalf("bad: %v", servers)
+	}
+}
+
+func TestHAProxyName(t *testing.T) {
+	type match struct {
+		inp    string
+		expect string
+	}
+	inps := []match{
+		{"web-1.example.com:80", "web-1.example.com:80"},
+		{"web 1/2", "web_1_2"},
+		{"wéb#1", "w_b_1"},
+		{"", ""},
+	}
+	for _, inp := range inps {
+		if out := haproxyName(inp.inp); out != inp.expect {
+			t.Fatalf("bad: %s %s", inp.inp, out)
+		}
+	}
+}
+
+func TestUnique(t *testing.T) {
+	out := unique([]string{"b", "a", "b"})
+	if !reflect.DeepEqual(out, []string{"b", "a"}) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	s1 := &ServerEntry{Address: "10.0.0.1", Port: 80}
+	s2 := &ServerEntry{Address: "10.0.0.1", Port: 81}
+	s3 := &ServerEntry{Address: "10.0.0.1", Port: 80}
+	out = unique([]*ServerEntry{s1, s2, s3})
+	if !reflect.DeepEqual(out, []*ServerEntry{s1, s2}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestSortEntries(t *testing.T) {
+	type match struct {
+		order  string
+		expect []string
+	}
+	inps := []match{
+		{"", []string{"web#2", "web-1.east", "web-3.east", "web-4"}},
+		{SortNode, []string{"web#2", "web-1.east", "web-3.east", "web-4"}},
+		{SortID, []string{"web-1.east", "web#2", "web-3.east", "web-4"}},
+		{SortAddress, []string{"web-1.east", "web#2", "web-3.east", "web-4"}},
+		{SortConsul, []string{"web-3.east", "web-1.east", "web#2", "web-4"}},
+	}
+	for _, inp := range inps {
+		entries := testTemplateServers()["app"]
+		sortEntries(inp.order, entries)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.NodeName)
+		}
+		if !reflect.DeepEqual(names, inp.expect) {
+			t.Fatalf("bad: %s %v", inp.order, names)
+		}
+	}
+}
+
+func TestAggregateServers_Deterministic(t *testing.T) {
+	// The same servers returned in a different order
+	// render the same configuration
+	var outputs [][]byte
+	for _, reverse := range []bool{false, true} {
+		entries := testTemplateServers()["app"]
+		if reverse {
+			for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+				entries[i], entries[j] = entries[j], entries[i]
+			}
+		}
+		wp := &WatchPath{Backend: "app"}
+		d := &backendData{
+			Servers:  map[*WatchPath][]*WatchEntry{wp: entries},
+			Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		}
+		out, err := buildTemplate(nil, "test-fixtures/simple.conf", newTemplateContext(&backendData{}, aggregateServers(&Config{}, d), nil))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		outputs = append(outputs, out)
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Fatalf("bad: %s %s", outputs[0], outputs[1])
+	}
+}
+
+// writeTemplate writes a template, moving its modification
+// time forward so the change is seen
+func writeTemplate(t *testing.T, path, contents string, age time.Duration) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	mtime := time.Now().Add(age)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestTemplateCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "haproxy.conf")
+	servers := testTemplateServers()
+	c := newTemplateCache("")
+
+	render := func(expect string) {
+		out, err := buildTemplate(c, path, newTemplateContext(&backendData{}, servers, map[string]string{"app": StatusOK}))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(out) != expect {
+			t.Fatalf("bad: %s", out)
+		}
+	}
+
+	// A missing template fails
+	if _, err := c.Load(path); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	writeTemplate(t, path, `{{len .app}}`, -time.Minute)
+	if changed, err := c.Load(path); err != nil || !changed {
+		t.Fatalf("bad: %v %v", changed, err)
+	}
+	if changed, err := c.Load(path); err != nil || changed {
+		t.Fatalf("bad: %v %v", changed, err)
+	}
+	render("4")
+
+	// A change is parsed again
+	writeTemplate(t, path, `{{status "app"}}`, -30*time.Second)
+	render("ok")
+
+	// An invalid change keeps the last good parse
+	writeTemplate(t, path, `{{range .app}`, -20*time.Second)
+	if changed, err := c.Load(path); err != nil || changed {
+		t.Fatalf("bad: %v %v", changed, err)
+	}
+	render("ok")
+
+	// As does removing the template
+	os.Remove(path)
+	render("ok")
+
+	writeTemplate(t, path, `{{len .app}} {{status "app"}}`, -10*time.Second)
+	if changed, err := c.Load(path); err != nil || !changed {
+		t.Fatalf("bad: %v %v", changed, err)
+	}
+	render("4 ok")
+}
+
+func TestRefreshTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	templ := filepath.Join(dir, "haproxy.conf.tmpl")
+	path := filepath.Join(dir, "haproxy.conf")
+	writeTemplate(t, templ, `servers {{len .app}}`, -time.Minute)
+
+	wp := &WatchPath{Backend: "app"}
+	conf := &Config{
+		Templates:     []string{templ},
+		Paths:         []string{path},
+		ReloadCommand: "true",
+		watches:       []*WatchPath{wp},
+	}
+	if err := conf.loadTemplate(templ); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d := &backendData{
+		Servers:  map[*WatchPath][]*WatchEntry{wp: testTemplateServers()["app"]},
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+	}
+
+	// Nothing is rendered while the template is unchanged
+	if refreshTemplates(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	writeTemplate(t, templ, `backend app {{len .app}}`, 0)
+	if refreshTemplates(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "backend app 4" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// A template that fails to execute keeps the existing file
+	writeTemplate(t, templ, `backend app {{index .app 10}}`, time.Minute)
+	if refreshTemplates(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	out, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "backend app 4" {
+		t.Fatalf("bad: %s", out)
+	}
+}
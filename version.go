@@ -0,0 +1,16 @@
+package main
+
+// The version of consul-haproxy
+const Version = "0.3.0"
+
+// VersionPrerelease marks a version that is not released yet,
+// such as "dev", and is empty for a release
+const VersionPrerelease = "dev"
+
+// versionString is the full version, including any prerelease
+func versionString() string {
+	if VersionPrerelease != "" {
+		return Version + "-" + VersionPrerelease
+	}
+	return Version
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math"
 	"net"
@@ -11,15 +10,18 @@ import (
 	"os/exec"
 	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
-	"text/template"
 	"time"
 
-	"github.com/armon/consul-api"
+	consulapi "github.com/hashicorp/consul/api"
 )
 
 const (
-	// failSleep controls how long to sleep on a failure
+	// failSleep controls how long to sleep on a failure,
+	// unless configured
 	failSleep = 5 * time.Second
 
 	// maxFailures controls the maximum number of failures
@@ -27,18 +29,30 @@ const (
 	maxFailures = 5
 
 	// waitTime is used to control how long we do a blocking
-	// query for
+	// query for, unless configured
 	waitTime = 60 * time.Second
+
+	// maxWaitTime is the longest blocking query Consul allows
+	maxWaitTime = 10 * time.Minute
+
+	// queryInterval is the minimum time between the queries
+	// of a watch, unless configured
+	queryInterval = time.Second
+
+	// nodeMaintCheckID and serviceMaintCheckPrefix identify the
+	// checks Consul registers for maintenance mode
+	nodeMaintCheckID        = "_node_maintenance"
+	serviceMaintCheckPrefix = "_service_maintenance:"
 )
 
 type backendData struct {
 	sync.Mutex
 
-	// Client is a shared Consul client
-	Client *consulapi.Client
+	// Clients are the shared Consul clients
+	Clients *consulClients
 
 	// Servers maps each watch path to a list of entries
-	Servers map[*WatchPath][]*consulapi.ServiceEntry
+	Servers map[*WatchPath][]*WatchEntry
 
 	// Backends maps a backend to a list of watch paths used
 	// to build up the server list
@@ -50,12 +64,105 @@ type backendData struct {
 	// StopCh is used to trigger a stop
 	StopCh chan struct{}
 
-	// quietTimer is used to wati for quiescence
-	quietTimer <-chan time.Time
+	// pending maps the index of an output to the refresh
+	// that is waiting for quiescence
+	pending map[int]*pendingRefresh
+
+	// refreshTimer fires when the earliest pending refresh is due
+	refreshTimer <-chan time.Time
+
+	// status tracks the result of the last query of each watch
+	status map[*WatchPath]*watchStatus
+
+	// reloadedServers is the server list of each backend as last
+	// loaded by HAProxy, used to detect changes that can be applied
+	// using the Runtime API. It is nil until the first reload.
+	reloadedServers map[string][]*WatchEntry
+
+	// guardedServers is the server list of each backend as last
+	// applied or restored from the state file, used to guard
+	// against removing too many servers
+	guardedServers map[string][]*WatchEntry
+
+	// trippedGuards are the backends whose guard is tripped,
+	// so the alert is only sent when a guard first trips
+	trippedGuards map[string]bool
+
+	// installedOutputs is the last installed render of each output
+	// path, used to skip rewriting a file when only the render
+	// timestamp has changed
+	installedOutputs map[string]*installedOutput
+}
+
+// installedOutput is the render of an output last written to its file
+type installedOutput struct {
+	// contents is what was written to the file
+	contents []byte
+
+	// stable is the render made without the render timestamp
+	stable []byte
+}
+
+// WatchEntry is a service entry returned by a watch path
+type WatchEntry struct {
+	*consulapi.ServiceEntry
+
+	// Watch is the watch path that returned the entry
+	Watch *WatchPath `json:"-"`
+
+	// NodeName is the node name registered in Consul, before it
+	// is prefixed to avoid conflicts between watches
+	NodeName string
+}
+
+// These are the states of a backend exposed to templates. A backend
+// is StatusError if a watch has failed without ever returning servers,
+// StatusStale if a watch has failed since it last returned servers or
+// its servers were restored from the state file, StatusEmpty if it has
+// no servers and StatusOK otherwise.
+const (
+	StatusOK    = "ok"
+	StatusEmpty = "empty"
+	StatusError = "error"
+	StatusStale = "stale"
+)
+
+// watchStatus tracks the result of the queries of a watch
+type watchStatus struct {
+	// Read is set once a query has succeeded
+	Read bool
+
+	// Err is the error of the last query, if it failed
+	Err error
+
+	// LastContact and KnownLeader describe how current the
+	// last successful query was
+	LastContact time.Duration
+	KnownLeader bool
+
+	// Index is the Consul index of the last successful query
+	Index uint64
+
+	// IndexResets counts how often the index of the watch
+	// went backwards or was zero
+	IndexResets int
+}
+
+// pendingRefresh tracks an output waiting for a quiet period
+type pendingRefresh struct {
+	// quiet is when the quiet period ends
+	quiet time.Time
 
-	// maxWaitTimer is used to prevent unbounded waiting
-	// for quiescence
-	maxWaitTimer <-chan time.Time
+	// maxWait is used to prevent unbounded waiting for quiescence
+	maxWait time.Time
+}
+
+// due returns when the refresh should take place
+func (p *pendingRefresh) due() time.Time {
+	if p.maxWait.Before(p.quiet) {
+		return p.maxWait
+	}
+	return p.quiet
 }
 
 // watch is used to start a long running watcher to handle updates.
@@ -72,39 +179,55 @@ func watch(conf *Config) (chan struct{}, chan struct{}) {
 func runWatch(conf *Config, stopCh, doneCh chan struct{}) {
 	defer close(doneCh)
 
-	// Create the consul client
-	consulConf := consulapi.DefaultConfig()
-	if conf.Address != "" {
-		consulConf.Address = conf.Address
-	}
-
-	// Attempt to contact the agent
-	client, err := consulapi.NewClient(consulConf)
+	// Create a client for each address
+	clients, err := newConsulClients(conf)
 	if err != nil {
-		log.Printf("[ERR] Failed to initialize consul client: %v", err)
-		return
-	}
-	if _, err := client.Agent().NodeName(); err != nil {
-		log.Printf("[ERR] Failed to contact consul agent: %v", err)
+		log.Printf("[ERR] %v", err)
 		return
 	}
 
 	// Create a backend store
 	data := &backendData{
-		Client:   client,
-		Servers:  make(map[*WatchPath][]*consulapi.ServiceEntry),
+		Clients:  clients,
+		Servers:  make(map[*WatchPath][]*WatchEntry),
 		Backends: make(map[string][]*WatchPath),
 		ChangeCh: make(chan struct{}, 1),
 		StopCh:   stopCh,
 	}
-
-	// Start the watches
-	data.Lock()
-	for idx, watch := range conf.watches {
+	for _, watch := range conf.watches {
 		data.Backends[watch.Backend] = append(data.Backends[watch.Backend], watch)
-		go runSingleWatch(conf, data, idx, watch)
 	}
-	data.Unlock()
+
+	// Seed the servers from the last known good state, so a watch
+	// that fails keeps its servers. With a cache startup, render
+	// the state while waiting for an agent.
+	if conf.StateFile != "" {
+		complete := restoreState(conf, data)
+		if complete && conf.Startup == StartupCache {
+			if forceRefresh(conf, data, conf.allOutputs()) {
+				return
+			}
+		}
+	}
+
+	// Wait for an agent to be available
+	if !waitForAgent(conf, clients, stopCh) {
+		return
+	}
+
+	// Start the watches, with a single query for the
+	// watch paths making identical queries
+	for _, shared := range groupWatches(conf) {
+		go runSharedWatch(conf, data, shared)
+	}
+
+	// Check the templates for changes
+	templateTicker := time.NewTicker(templatePollInterval)
+	defer templateTicker.Stop()
+
+	// Return to the preferred agent once it recovers
+	failBackTicker := time.NewTicker(failBackInterval)
+	defer failBackTicker.Stop()
 
 	// Monitor for changes or stop
 	for {
@@ -114,17 +237,17 @@ func runWatch(conf *Config, stopCh, doneCh chan struct{}) {
 				return
 			}
 
-		case <-data.quietTimer:
-			data.quietTimer = nil
-			data.maxWaitTimer = nil
-			if forceRefresh(conf, data) {
+		case <-templateTicker.C:
+			if refreshTemplates(conf, data) {
 				return
 			}
 
-		case <-data.maxWaitTimer:
-			data.quietTimer = nil
-			data.maxWaitTimer = nil
-			if forceRefresh(conf, data) {
+		case <-failBackTicker.C:
+			go clients.FailBack()
+
+		case <-data.refreshTimer:
+			data.refreshTimer = nil
+			if refreshDue(conf, data) {
 				return
 			}
 
@@ -141,31 +264,139 @@ func maybeRefresh(conf *Config, data *backendData) (exit bool) {
 		return
 	}
 
-	// If a quiet period is enabled, start the timer
-	if conf.Quiet != 0 {
-		data.quietTimer = time.After(conf.Quiet)
-		if data.maxWaitTimer == nil {
-			data.maxWaitTimer = time.After(conf.MaxWait)
+	// Avoid reloading HAProxy if the Runtime API can apply the change.
+	// The other outputs know nothing of the slots, so are still rendered.
+	runtime := applyRuntime(conf, data)
+
+	// Outputs with a quiet period wait for it, the rest
+	// are refreshed immediately
+	now := time.Now()
+	var immediate []*OutputConfig
+	for idx, out := range conf.allOutputs() {
+		if runtime && out.Runtime {
+			delete(data.pending, idx)
+			continue
+		}
+		if out.quiet == 0 {
+			immediate = append(immediate, out)
+			continue
+		}
+		if data.pending == nil {
+			data.pending = make(map[int]*pendingRefresh)
+		}
+		p, ok := data.pending[idx]
+		if !ok {
+			p = &pendingRefresh{maxWait: now.Add(out.maxWait)}
+			data.pending[idx] = p
 		}
+		p.quiet = now.Add(out.quiet)
+	}
+	scheduleRefresh(data, now)
+
+	if len(immediate) == 0 {
 		return
 	}
+	return forceRefresh(conf, data, immediate)
+}
+
+// refreshDue is used to refresh the outputs that have
+// finished waiting for a quiet period
+func refreshDue(conf *Config, data *backendData) (exit bool) {
+	// Wait until the watches are ready again, which triggers
+	// another change that reschedules the pending refreshes
+	if !allWatchesReturned(conf, data) {
+		return
+	}
+
+	now := time.Now()
+	var due []int
+	for idx, p := range data.pending {
+		if !p.due().After(now) {
+			due = append(due, idx)
+			delete(data.pending, idx)
+		}
+	}
+	scheduleRefresh(data, now)
 
-	return forceRefresh(conf, data)
+	if len(due) == 0 {
+		return
+	}
+	sort.Ints(due)
+	all := conf.allOutputs()
+	outputs := make([]*OutputConfig, len(due))
+	for i, idx := range due {
+		outputs[i] = all[idx]
+	}
+	return forceRefresh(conf, data, outputs)
 }
 
-// forceRefresh is used to immediately refresh
-func forceRefresh(conf *Config, data *backendData) (exit bool) {
-	// Merge the data for each backend
-	backendServers := aggregateServers(data)
+// refreshTemplates is used to refresh the outputs
+// whose templates have changed
+func refreshTemplates(conf *Config, data *backendData) (exit bool) {
+	if conf.templates == nil || !allWatchesReturned(conf, data) {
+		return
+	}
+	changed := make(map[string]bool)
+	var outputs []*OutputConfig
+	for _, out := range conf.allOutputs() {
+		ok, seen := changed[out.Template]
+		if !seen {
+			ok, _ = conf.templates.Load(out.Template)
+			changed[out.Template] = ok
+		}
+		if ok {
+			outputs = append(outputs, out)
+		}
+	}
+	if len(outputs) == 0 {
+		return
+	}
+	return forceRefresh(conf, data, outputs)
+}
+
+// scheduleRefresh sets the refresh timer to fire when the
+// earliest pending refresh is due
+func scheduleRefresh(data *backendData, now time.Time) {
+	data.refreshTimer = nil
+	var next time.Time
+	for _, p := range data.pending {
+		if due := p.due(); next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	if !next.IsZero() {
+		data.refreshTimer = time.After(next.Sub(now))
+	}
+}
+
+// forceRefresh is used to immediately refresh the given outputs
+func forceRefresh(conf *Config, data *backendData, outputs []*OutputConfig) (exit bool) {
+	// Merge the data for each backend, holding back any update
+	// that would remove too many servers
+	backendServers, tripped := guardServers(conf, data, aggregateServers(conf, data))
+	state := newSavedState(conf, data)
 
-	// Iterate through the list of templates to render
-	for idx, templatePath := range conf.Templates {
+	// Render all the templates before touching any files. An output
+	// whose template fails keeps its existing file, so a bad edit to a
+	// template does not stop the other outputs from being updated.
+	status := backendStatus(data)
+	context := newTemplateContext(data, backendServers, status)
+	rendered := make([][]byte, len(outputs))
+	skipped := make([]bool, len(outputs))
+	failed := false
+	for idx, out := range outputs {
 
 		// Build the output template
-		output, err := buildTemplate(templatePath, backendServers)
+		output, err := buildTemplate(conf.templates, out.Template, context)
 		if err != nil {
-			log.Printf("[ERR] %v", err)
-			return true
+			log.Printf("[ERR] Failed to render %s, keeping existing configuration: %v",
+				out.Template, err)
+			if conf.DryRun {
+				return true
+			}
+			skipped[idx] = true
+			failed = true
+			continue
 		}
 
 		// Check for a dry run
@@ -173,145 +404,681 @@ func forceRefresh(conf *Config, data *backendData) (exit bool) {
 			fmt.Printf("%s\n", output)
 			return true
 		}
+		rendered[idx] = output
+	}
+
+	// Stage the new configuration next to the existing files
+	var staged []*stagedFile
+	var changed []*OutputConfig
+	var installed []*installedOutput
+	stableContext := withoutTimestamp(context)
+	defer func() {
+		for _, s := range staged {
+			s.Abort()
+		}
+	}()
+	for idx, output := range rendered {
+		out := outputs[idx]
+		if skipped[idx] {
+			continue
+		}
+
+		// Avoid rewriting files which are already up to date
+		if fileContentsEqual(out.Path, output) {
+			continue
+		}
+
+		// Avoid rewriting files which only differ by the render timestamp,
+		// as long as the file still has what was last written to it
+		stable, err := buildTemplate(conf.templates, out.Template, stableContext)
+		last := data.installedOutputs[out.Path]
+		if err == nil && last != nil && !bytes.Equal(stable, output) &&
+			bytes.Equal(stable, last.stable) && fileContentsEqual(out.Path, last.contents) {
+			continue
+		}
 
-		// Write out the configuration
-		if err := ioutil.WriteFile(conf.Paths[idx], output, 0660); err != nil {
-			log.Printf("[ERR] Failed to write config file at %s: %v", conf.Paths[idx], err)
+		s, err := stageFile(out.Path, output, out.mode)
+		if err != nil {
+			log.Printf("[ERR] Failed to write config file at %s: %v", out.Path, err)
 			return true
 		}
-		log.Printf("[INFO] Updated configuration file at %s", conf.Paths[idx])
+		staged = append(staged, s)
+		changed = append(changed, out)
+		installed = append(installed, &installedOutput{contents: output, stable: stable})
 	}
 
-	// Invoke the reload hook
-	if err := reload(conf); err != nil {
-		log.Printf("[ERR] Failed to reload: %v", err)
-	} else {
-		log.Printf("[INFO] Completed reload")
+	// Avoid a reload if nothing has changed
+	if len(staged) == 0 {
+		log.Printf("[INFO] Configuration unchanged, skipping reload")
+		data.guardedServers = backendServers
+		if conf.RuntimeSocket == "" || includesRuntime(outputs) {
+			data.reloadedServers = backendServers
+			syncRuntime(conf, backendServers)
+		}
+		if !tripped && !failed {
+			persistState(conf, state)
+		}
+		return
+	}
+
+	// Validate the new configuration before installing it, keeping
+	// the existing configuration of only the outputs that fail
+	var checked []*stagedFile
+	var checkedOutputs []*OutputConfig
+	var checkedInstalled []*installedOutput
+	for idx, s := range staged {
+		out := changed[idx]
+		if out.CheckCommand != "" {
+			if err := checkConfig(out.CheckCommand, s.TmpPath); err != nil {
+				log.Printf("[ERR] Configuration check failed for %s, keeping existing configuration: %v",
+					s.Path, err)
+				s.Abort()
+				failed = true
+				continue
+			}
+		}
+		checked = append(checked, s)
+		checkedOutputs = append(checkedOutputs, out)
+		checkedInstalled = append(checkedInstalled, installed[idx])
+	}
+	staged, changed, installed = checked, checkedOutputs, checkedInstalled
+	if len(staged) == 0 {
+		return
+	}
+
+	// Snapshot the existing configuration in case we need to roll back
+	backups := make([]*fileBackup, len(staged))
+	for idx, s := range staged {
+		b, err := backupFile(s.Path)
+		if err != nil {
+			log.Printf("[ERR] Failed to backup config file at %s: %v", s.Path, err)
+			return true
+		}
+		backups[idx] = b
+	}
+
+	// Install the new configuration
+	for _, s := range staged {
+		if err := s.Commit(); err != nil {
+			log.Printf("[ERR] Failed to write config file at %s: %v", s.Path, err)
+			restoreBackups(backups)
+			return true
+		}
+		log.Printf("[INFO] Updated configuration file at %s", s.Path)
+	}
+
+	// Invoke each distinct reload hook once for the changed outputs,
+	// rolling back only the files belonging to a failed reload
+	var commands []string
+	commandBackups := make(map[string][]*fileBackup)
+	for idx, out := range changed {
+		if _, ok := commandBackups[out.ReloadCommand]; !ok {
+			commands = append(commands, out.ReloadCommand)
+		}
+		commandBackups[out.ReloadCommand] = append(commandBackups[out.ReloadCommand], backups[idx])
+	}
+	reloaded := true
+	failedCommands := make(map[string]bool)
+	for _, command := range commands {
+		if err := reload(command); err != nil {
+			log.Printf("[ERR] Failed to reload, restoring previous configuration: %v", err)
+			restoreBackups(commandBackups[command])
+			failedCommands[command] = true
+			reloaded = false
+		} else {
+			log.Printf("[INFO] Completed reload")
+		}
+	}
+
+	// Track the installed renders of the outputs
+	if data.installedOutputs == nil {
+		data.installedOutputs = make(map[string]*installedOutput)
+	}
+	for idx, out := range changed {
+		if failedCommands[out.ReloadCommand] {
+			delete(data.installedOutputs, out.Path)
+		} else {
+			data.installedOutputs[out.Path] = installed[idx]
+		}
+	}
+
+	// Track what is now loaded, and populate any runtime slots
+	if reloaded {
+		data.guardedServers = backendServers
+		if conf.RuntimeSocket == "" || includesRuntime(outputs) {
+			data.reloadedServers = backendServers
+			syncRuntime(conf, backendServers)
+		}
+		if !tripped && !failed {
+			persistState(conf, state)
+		}
 	}
 	return
 }
 
-// allWatchesReturned checks if all the watches have some
-// data registered. Prevents early template generation.
+// restoreBackups is used to roll back to a previous configuration
+func restoreBackups(backups []*fileBackup) {
+	for _, b := range backups {
+		if err := b.Restore(); err != nil {
+			log.Printf("[ERR] Failed to restore config file at %s: %v", b.Path, err)
+		} else {
+			log.Printf("[INFO] Restored configuration file at %s", b.Path)
+		}
+	}
+}
+
+// allWatchesReturned checks if the watches are ready to render
+// according to the error policy. Prevents early template generation.
 func allWatchesReturned(conf *Config, data *backendData) bool {
 	data.Lock()
 	defer data.Unlock()
-	return len(data.Servers) >= len(conf.watches)
+	for _, watch := range conf.watches {
+		_, ok := data.Servers[watch]
+		status := data.status[watch]
+		failed := status != nil && status.Err != nil
+		switch conf.ErrorPolicy {
+		case PolicyRender:
+			if !ok && !failed {
+				return false
+			}
+		case PolicyHold:
+			if !ok || failed {
+				return false
+			}
+		default:
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// queryOptions returns the options used to query a watch, and the
+// maximum staleness of a stale result
+func queryOptions(conf *Config, watch *WatchPath) (*consulapi.QueryOptions, time.Duration) {
+	opts := &consulapi.QueryOptions{
+		Datacenter: watch.Datacenter,
+		WaitTime:   waitTime,
+	}
+	if conf.WaitTime != 0 {
+		opts.WaitTime = conf.WaitTime
+	}
+	if watch.WaitTime != 0 {
+		opts.WaitTime = watch.WaitTime
+	}
+
+	consistency := conf.Consistency
+	if watch.Consistency != "" {
+		consistency = watch.Consistency
+	}
+	switch consistency {
+	case ConsistencyStale:
+		opts.AllowStale = true
+	case ConsistencyConsistent:
+		opts.RequireConsistent = true
+	}
+
+	maxStale := conf.MaxStale
+	if watch.MaxStale != 0 {
+		maxStale = watch.MaxStale
+	}
+	return opts, maxStale
+}
+
+// logQueryMeta logs how current the result of a query is
+func logQueryMeta(conf *Config, spec string, qm *consulapi.QueryMeta) {
+	if conf.DryRun {
+		return
+	}
+	if !qm.KnownLeader {
+		log.Printf("[WARN] No known leader for %s, the result may be stale", spec)
+	}
+	log.Printf("[DEBUG] Query for %s returned index %d, last contact %v, known leader %v",
+		spec, qm.LastIndex, qm.LastContact, qm.KnownLeader)
+}
+
+// recordQueryMeta tracks how current the last result of a watch is
+func recordQueryMeta(data *backendData, watch *WatchPath, qm *consulapi.QueryMeta) {
+	data.Lock()
+	defer data.Unlock()
+	if data.status == nil {
+		data.status = make(map[*WatchPath]*watchStatus)
+	}
+	status, ok := data.status[watch]
+	if !ok {
+		status = &watchStatus{}
+		data.status[watch] = status
+	}
+	status.LastContact = qm.LastContact
+	status.KnownLeader = qm.KnownLeader
+	status.Index = qm.LastIndex
+}
+
+// nextWaitIndex returns the index to block on after a query returned
+// the given index. An index that went backwards, such as after a
+// snapshot restore, or is zero would not block, so the query starts
+// over instead. Returns if the index was reset.
+func nextWaitIndex(last, index uint64) (uint64, bool) {
+	if index == 0 || index < last {
+		return 0, true
+	}
+	return index, false
+}
+
+// recordIndexReset counts a reset of the index of a watch
+func recordIndexReset(data *backendData, watch *WatchPath) {
+	data.Lock()
+	defer data.Unlock()
+	if data.status == nil {
+		data.status = make(map[*WatchPath]*watchStatus)
+	}
+	status, ok := data.status[watch]
+	if !ok {
+		status = &watchStatus{}
+		data.status[watch] = status
+	}
+	status.IndexResets++
+}
+
+// updateWatch records the result of a query of a watch, notifying
+// of any change. A failed query keeps any previous entries, so a watch
+// that has never succeeded stays not ready. The first successful read
+// is always reported, even if it matches servers restored from the
+// state file, as is any change of status. Returns if there was a change.
+func updateWatch(data *backendData, watch *WatchPath, servers []*WatchEntry, err error) bool {
+	data.Lock()
+	defer data.Unlock()
+	if data.status == nil {
+		data.status = make(map[*WatchPath]*watchStatus)
+	}
+	status, ok := data.status[watch]
+	if !ok {
+		status = &watchStatus{}
+		data.status[watch] = status
+	}
+
+	failed := status.Err != nil
+	if err != nil {
+		status.Err = err
+		if failed {
+			return false
+		}
+	} else {
+		if status.Read && !failed && reflect.DeepEqual(data.Servers[watch], servers) {
+			return false
+		}
+		data.Servers[watch] = servers
+		status.Read = true
+		status.Err = nil
+	}
+	asyncNotify(data.ChangeCh)
+	return true
+}
+
+// backendStatus returns the status of each backend
+func backendStatus(data *backendData) map[string]string {
+	out := make(map[string]string)
+	data.Lock()
+	defer data.Unlock()
+	for backend, watches := range data.Backends {
+		errored, stale, servers := false, false, 0
+		for _, watch := range watches {
+			entries, ok := data.Servers[watch]
+			status := data.status[watch]
+			servers += len(entries)
+			switch {
+			case !ok:
+				errored = true
+			case status == nil || !status.Read || status.Err != nil:
+				stale = true
+			}
+		}
+		switch {
+		case errored:
+			out[backend] = StatusError
+		case stale:
+			out[backend] = StatusStale
+		case servers == 0:
+			out[backend] = StatusEmpty
+		default:
+			out[backend] = StatusOK
+		}
+	}
+	return out
 }
 
 // aggregateServers merges the watches belonging to each
-// backend together to prepare for template generation
-func aggregateServers(data *backendData) map[string][]*consulapi.ServiceEntry {
-	backendServers := make(map[string][]*consulapi.ServiceEntry)
+// backend together to prepare for template generation,
+// sorting the servers of each backend in the configured order
+func aggregateServers(conf *Config, data *backendData) map[string][]*WatchEntry {
+	backendServers := make(map[string][]*WatchEntry)
 	data.Lock()
 	defer data.Unlock()
 	for backend, watches := range data.Backends {
-		var all []*consulapi.ServiceEntry
+		var all []*WatchEntry
 		for _, watch := range watches {
 			entries := data.Servers[watch]
 			all = append(all, entries...)
 		}
+		sortEntries(conf.Sort, all)
 		backendServers[backend] = all
 	}
 	return backendServers
 }
 
 // buildTemplate is used to build the output templates
-// from the configuration and server list
-func buildTemplate(templatePath string,
-	servers map[string][]*consulapi.ServiceEntry) ([]byte, error) {
-	// Format the output
-	outVars := formatOutput(servers)
-
-	// Read the template
-	raw, err := ioutil.ReadFile(templatePath)
+// from the template context
+func buildTemplate(templates *templateCache, templatePath string,
+	context map[string]interface{}) ([]byte, error) {
+	// Get the parsed template, and bind the functions to a
+	// copy so the cached template is not modified
+	templ, err := templates.Get(templatePath)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to read template: %v", err)
+		return nil, err
 	}
-
-	// Create the template
-	templ, err := template.New("output").Parse(string(raw))
+	templ, err = templ.Clone()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to parse the template: %v", err)
+		return nil, fmt.Errorf("Failed to copy the template: %v", err)
 	}
+	var partialsDir string
+	if templates != nil {
+		partialsDir = templates.partialsDir
+	}
+	templ.Funcs(templateFuncs(contextStatus(context), templ, partialsDir))
 
 	// Generate the output
 	var output bytes.Buffer
-	if err := templ.Execute(&output, outVars); err != nil {
+	if err := templ.Execute(&output, context); err != nil {
 		return nil, fmt.Errorf("Failed to generate the template: %v", err)
 	}
 	return output.Bytes(), nil
 }
 
-// runSingleWatch is used to query a single watch path for changes
-func runSingleWatch(conf *Config, data *backendData, idx int, watch *WatchPath) {
-	health := data.Client.Health()
-	opts := &consulapi.QueryOptions{
-		WaitTime: waitTime,
+// watchQuery identifies the blocking query made for a watch path.
+// Watch paths that make the same query share a single watcher.
+type watchQuery struct {
+	Service           string
+	Tag               string
+	Datacenter        string
+	PassingOnly       bool
+	AllowStale        bool
+	RequireConsistent bool
+	MaxStale          time.Duration
+	WaitTime          time.Duration
+}
+
+// sharedWatch is a single blocking query whose results
+// are used by every watch path making that query
+type sharedWatch struct {
+	Query watchQuery
+
+	// Watches are the watch paths using the query, and Indexes
+	// their position in the configuration, used to prefix the
+	// node names
+	Watches []*WatchPath
+	Indexes []int
+}
+
+// newWatchQuery returns the query made for a watch path. Only the
+// first tag can be filtered by Consul, the rest are filtered locally,
+// as is the warning health state.
+func newWatchQuery(conf *Config, watch *WatchPath) watchQuery {
+	opts, maxStale := queryOptions(conf, watch)
+	var tag string
+	if len(watch.Tags) > 0 {
+		tag = watch.Tags[0]
+	}
+	return watchQuery{
+		Service:           watch.Service,
+		Tag:               tag,
+		Datacenter:        watch.Datacenter,
+		PassingOnly:       watch.Health == "" || watch.Health == HealthPassing,
+		AllowStale:        opts.AllowStale,
+		RequireConsistent: opts.RequireConsistent,
+		MaxStale:          maxStale,
+		WaitTime:          opts.WaitTime,
+	}
+}
+
+// groupWatches collapses the watch paths making identical
+// queries into shared watches, in configuration order
+func groupWatches(conf *Config) []*sharedWatch {
+	var out []*sharedWatch
+	byQuery := make(map[watchQuery]*sharedWatch)
+	for idx, watch := range conf.watches {
+		query := newWatchQuery(conf, watch)
+		shared, ok := byQuery[query]
+		if !ok {
+			shared = &sharedWatch{Query: query}
+			byQuery[query] = shared
+			out = append(out, shared)
+		}
+		shared.Watches = append(shared.Watches, watch)
+		shared.Indexes = append(shared.Indexes, idx)
+	}
+	return out
+}
+
+// String returns the specs of the watch paths using the query
+func (s *sharedWatch) String() string {
+	specs := make([]string, len(s.Watches))
+	for i, watch := range s.Watches {
+		specs[i] = watch.Spec
 	}
-	if watch.Datacenter != "" {
-		opts.Datacenter = watch.Datacenter
+	return strings.Join(specs, ", ")
+}
+
+// runSharedWatch is used to query a shared watch for changes,
+// updating every watch path using it
+func runSharedWatch(conf *Config, data *backendData, shared *sharedWatch) {
+	query := shared.Query
+	opts := &consulapi.QueryOptions{
+		Datacenter:        query.Datacenter,
+		AllowStale:        query.AllowStale,
+		RequireConsistent: query.RequireConsistent,
+		WaitTime:          query.WaitTime,
 	}
+	spec := shared.String()
 
-	failures := 0
+	retry := newRetrier(conf)
+	var lastQuery time.Time
 	for {
+		// Limit how often the watch is queried, in case
+		// the queries stop blocking
+		if wait := conf.QueryInterval - time.Since(lastQuery); wait > 0 {
+			time.Sleep(wait)
+		}
 		if shouldStop(data.StopCh) {
 			return
 		}
-		entries, qm, err := health.Service(watch.Service, watch.Tag, true, opts)
+		lastQuery = time.Now()
+
+		client, clientIdx := data.Clients.Client()
+		entries, qm, err := client.Health().Service(query.Service, query.Tag, query.PassingOnly, opts)
+
+		// A stale result that is too far behind the leader is
+		// read again from the leader
+		if err == nil && opts.AllowStale && query.MaxStale > 0 && qm.LastContact > query.MaxStale {
+			log.Printf("[WARN] Result for %s is %v behind the leader, querying the leader",
+				spec, qm.LastContact)
+			leaderOpts := *opts
+			leaderOpts.AllowStale = false
+			entries, qm, err = client.Health().Service(query.Service, query.Tag, query.PassingOnly, &leaderOpts)
+		}
 		if err != nil {
-			log.Printf("[ERR] Failed to fetch service nodes: %v", err)
+			log.Printf("[ERR] Failed to fetch service nodes for %s: %v", spec, consulError(err))
+		} else {
+			logQueryMeta(conf, spec, qm)
 		}
 
-		// Patch the entries as necessary
+		// Clear the health output to prevent reloading due to changes
+		// in output text since we don't care.
 		for _, entry := range entries {
-			// Modify the node name to prefix with the watch ID. This
-			// prevents a name conflict on duplicate names
-			entry.Node.Node = fmt.Sprintf("%d_%s", idx, entry.Node.Node)
-
-			// Patch the port if provided
-			if watch.Port != 0 {
-				entry.Service.Port = watch.Port
-			}
-
-			// Clear the health output to prevent reloading due to changes
-			// in output text since we don't care.
 			for _, c := range entry.Checks {
 				c.Notes = ""
 				c.Output = ""
 			}
 		}
 
-		// Update the entries. If this is the first read, do it on error
-		data.Lock()
-		old, ok := data.Servers[watch]
-		if !ok || (err == nil && !reflect.DeepEqual(old, entries)) {
-			data.Servers[watch] = entries
-			asyncNotify(data.ChangeCh)
-			if !conf.DryRun {
+		// Update the entries of each watch path
+		for i, watch := range shared.Watches {
+			if err == nil {
+				recordQueryMeta(data, watch, qm)
+			}
+			servers := watchEntries(watch, shared.Indexes[i], entries)
+			if updateWatch(data, watch, servers, err) && err == nil && !conf.DryRun {
 				log.Printf("[DEBUG] Updated nodes for %v", watch.Spec)
 			}
 		}
-		data.Unlock()
 
-		// Stop immediately on a dry run
-		if conf.DryRun {
+		// Stop after the first successful read on a dry run
+		if conf.DryRun && err == nil {
 			return
 		}
 
-		// Check for an error
+		// Check for an error. If another agent is available, retry
+		// against it immediately. The index may differ between
+		// agents, so the query starts over.
 		if err != nil {
-			failures = min(failures+1, maxFailures)
-			time.Sleep(backoff(failSleep, failures))
+			if !isPermissionDenied(err) && data.Clients.Failover(clientIdx) {
+				opts.WaitIndex = 0
+				continue
+			}
+			time.Sleep(retry.Failure(time.Now()))
 		} else {
-			failures = 0
-			opts.WaitIndex = qm.LastIndex
+			retry.Success(time.Now())
+			index, reset := nextWaitIndex(opts.WaitIndex, qm.LastIndex)
+			if reset {
+				log.Printf("[WARN] Index for %s went from %d to %d, resetting",
+					spec, opts.WaitIndex, qm.LastIndex)
+				for _, watch := range shared.Watches {
+					recordIndexReset(data, watch)
+				}
+			}
+			opts.WaitIndex = index
+		}
+	}
+}
+
+// watchEntries filters the result of a query for a watch path, and
+// patches copies of the matching entries for it, since the result
+// may be shared with other watch paths
+func watchEntries(watch *WatchPath, idx int, entries []*consulapi.ServiceEntry) []*WatchEntry {
+	entries = filterEntries(watch, entries)
+	servers := make([]*WatchEntry, len(entries))
+	for i, entry := range entries {
+		node := *entry.Node
+		service := *entry.Service
+		servers[i] = &WatchEntry{
+			ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &node,
+				Service: &service,
+				Checks:  entry.Checks,
+			},
+			Watch:    watch,
+			NodeName: node.Node,
+		}
+
+		// Modify the node name to prefix with the watch ID. This
+		// prevents a name conflict on duplicate names
+		node.Node = fmt.Sprintf("%d_%s", idx, node.Node)
+
+		// Default to the datacenter of the watch
+		if node.Datacenter == "" {
+			node.Datacenter = watch.Datacenter
+		}
+
+		// Patch the port if provided
+		if watch.Port != 0 {
+			service.Port = watch.Port
+		}
+	}
+	return servers
+}
+
+// filterEntries removes the entries which do not match the
+// tags or health state required by a watch path
+func filterEntries(watch *WatchPath, entries []*consulapi.ServiceEntry) []*consulapi.ServiceEntry {
+	var out []*consulapi.ServiceEntry
+	for _, entry := range entries {
+		if !hasTags(entry.Service.Tags, watch.Tags, true) {
+			continue
+		}
+		if hasTags(entry.Service.Tags, watch.ExcludeTags, false) {
+			continue
+		}
+		if watch.Health == HealthWarning {
+			if health := aggregateHealth(entry.Checks); health != HealthPassing && health != HealthWarning {
+				continue
+			}
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+// hasTags checks if all (or any) of the wanted tags are present
+func hasTags(tags, want []string, all bool) bool {
+	for _, w := range want {
+		found := false
+		for _, t := range tags {
+			if t == w {
+				found = true
+				break
+			}
+		}
+		if found != all {
+			return found
 		}
 	}
+	return all
+}
+
+// aggregateHealth returns the worst status of a set of checks.
+// Maintenance mode is reported by Consul as a critical check with
+// a reserved ID, and takes precedence over any other status.
+func aggregateHealth(checks []*consulapi.HealthCheck) string {
+	status := HealthPassing
+	for _, c := range checks {
+		if c.CheckID == nodeMaintCheckID || strings.HasPrefix(c.CheckID, serviceMaintCheckPrefix) {
+			return HealthMaint
+		}
+		switch c.Status {
+		case HealthCritical:
+			status = HealthCritical
+		case HealthWarning:
+			if status != HealthCritical {
+				status = HealthWarning
+			}
+		}
+	}
+	return status
 }
 
 // reload is used to invoke the reload command
-func reload(conf *Config) error {
+func reload(command string) error {
+	return runCommand(command)
+}
+
+// checkConfig is used to invoke the check command against
+// a rendered configuration file
+func checkConfig(command, path string) error {
+	return runCommand(strings.Replace(command, "{{path}}", shellQuote(path), -1))
+}
+
+// shellQuote quotes a value so the system shell passes
+// it through as a single argument
+func shellQuote(s string) string {
+	if runtime.GOOS == "windows" {
+		return `"` + s + `"`
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// runCommand is used to invoke a command using the system shell,
+// with any environment variables given as "key=value"
+func runCommand(command string, env ...string) error {
 	// Determine the shell invocation based on OS
 	var shell, flag string
 	if runtime.GOOS == "windows" {
@@ -323,9 +1090,12 @@ func reload(conf *Config) error {
 	}
 
 	// Create and invoke the command
-	cmd := exec.Command(shell, flag, conf.ReloadCommand)
+	cmd := exec.Command(shell, flag, command)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	return cmd.Run()
 }
 
@@ -370,32 +1140,128 @@ type ServerEntry struct {
 	Port    int
 	IP      net.IP
 	Node    string
+
+	// Address is the address of the server, which is the service
+	// address if registered (unless the backend uses the node address)
+	// or the node address. This may be a hostname, in which case IP
+	// is nil.
+	Address string
+
+	// NodeName is the node name without the watch prefix
+	NodeName string
+
+	// Datacenter is the datacenter of the node
+	Datacenter string
+
+	// Spec is the backend specification that returned the server
+	Spec string
+
+	// ServiceAddress is the address registered for the service,
+	// which may differ from the node address
+	ServiceAddress string
+
+	// NodeMeta and ServiceMeta are the metadata of the node
+	// and the service
+	NodeMeta    map[string]string
+	ServiceMeta map[string]string
+
+	// Weights are the service weights used for DNS load balancing
+	Weights Weights
+
+	// Health is the aggregate health of the server, one of
+	// passing, warning, critical or maintenance
+	Health string
+
+	// Checks are the health checks of the node and service
+	Checks []*CheckEntry
+}
+
+// Weights are the relative weights of a service, depending
+// on whether it is passing or warning
+type Weights struct {
+	Passing int
+	Warning int
+}
+
+// CheckEntry is a health check exposed to the template
+type CheckEntry struct {
+	ID        string
+	Name      string
+	Status    string
+	ServiceID string
 }
 
 // String is the default text representation of a server
 func (se *ServerEntry) String() string {
 	name := fmt.Sprintf("%s_%s", se.Node, se.ID)
-	addr := &net.TCPAddr{IP: se.IP, Port: se.Port}
+	addr := net.JoinHostPort(se.Address, strconv.Itoa(se.Port))
+	if se.Disabled() {
+		return fmt.Sprintf("server %s %s disabled", name, addr)
+	}
 	return fmt.Sprintf("server %s %s", name, addr)
 }
 
+// Disabled checks if the server should not receive traffic,
+// because it is critical or in maintenance
+func (se *ServerEntry) Disabled() bool {
+	return se.Health == HealthCritical || se.Health == HealthMaint
+}
+
 // formatOutput converts the service entries into a format
 // suitable for templating into the HAProxy file
-func formatOutput(inp map[string][]*consulapi.ServiceEntry) map[string][]*ServerEntry {
+func formatOutput(inp map[string][]*WatchEntry) map[string][]*ServerEntry {
 	out := make(map[string][]*ServerEntry)
 	for backend, entries := range inp {
 		servers := make([]*ServerEntry, len(entries))
 		for idx, entry := range entries {
-			servers[idx] = &ServerEntry{
-				ID:      entry.Service.ID,
-				Service: entry.Service.Service,
-				Tags:    entry.Service.Tags,
-				Port:    entry.Service.Port,
-				IP:      net.ParseIP(entry.Node.Address),
-				Node:    entry.Node.Node,
-			}
+			servers[idx] = newServerEntry(entry)
 		}
 		out[backend] = servers
 	}
 	return out
 }
+
+// newServerEntry converts a service entry into a server
+func newServerEntry(entry *WatchEntry) *ServerEntry {
+	checks := make([]*CheckEntry, len(entry.Checks))
+	for i, c := range entry.Checks {
+		checks[i] = &CheckEntry{
+			ID:        c.CheckID,
+			Name:      c.Name,
+			Status:    c.Status,
+			ServiceID: c.ServiceID,
+		}
+	}
+	address := entry.Node.Address
+	useNode := entry.Watch != nil && entry.Watch.Address == AddressNode
+	if entry.Service.Address != "" && !useNode {
+		address = entry.Service.Address
+	}
+	server := &ServerEntry{
+		ID:             entry.Service.ID,
+		Service:        entry.Service.Service,
+		Tags:           entry.Service.Tags,
+		Port:           entry.Service.Port,
+		IP:             net.ParseIP(address),
+		Address:        address,
+		Node:           entry.Node.Node,
+		NodeName:       entry.NodeName,
+		Datacenter:     entry.Node.Datacenter,
+		ServiceAddress: entry.Service.Address,
+		NodeMeta:       entry.Node.Meta,
+		ServiceMeta:    entry.Service.Meta,
+		Weights: Weights{
+			Passing: entry.Service.Weights.Passing,
+			Warning: entry.Service.Weights.Warning,
+		},
+		Health: aggregateHealth(entry.Checks),
+		Checks: checks,
+	}
+	if server.NodeName == "" {
+		server.NodeName = entry.Node.Node
+	}
+	if entry.Watch != nil {
+		server.Spec = entry.Watch.Spec
+	}
+	return server
+}
@@ -2,9 +2,17 @@ package main
 
 import (
 	"bytes"
-	"github.com/armon/consul-api"
+	"fmt"
+	consulapi "github.com/hashicorp/consul/api"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -14,20 +22,20 @@ func TestMaybeRefresh(t *testing.T) {
 	defer os.Remove("config_out2")
 	defer os.Remove("reload_out")
 
-	en1 := &consulapi.ServiceEntry{
+	en1 := &WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
 		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
 		Service: &consulapi.AgentService{ID: "app", Port: 8000},
-	}
-	en2 := &consulapi.ServiceEntry{
+	}}
+	en2 := &WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
 		Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
 		Service: &consulapi.AgentService{ID: "app", Port: 8000},
-	}
+	}}
 	wp1 := &WatchPath{Backend: "app"}
 	wp2 := &WatchPath{Backend: "app"}
 	d := &backendData{
-		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
-			wp1: []*consulapi.ServiceEntry{en1},
-			wp2: []*consulapi.ServiceEntry{en2},
+		Servers: map[*WatchPath][]*WatchEntry{
+			wp1: []*WatchEntry{en1},
+			wp2: []*WatchEntry{en2},
 		},
 		Backends: map[string][]*WatchPath{
 			"app": []*WatchPath{wp1, wp2},
@@ -94,7 +102,7 @@ func TestAllWatchesReturned(t *testing.T) {
 	wp2 := &WatchPath{Backend: "app"}
 	wp3 := &WatchPath{Backend: "db"}
 	d := &backendData{
-		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
+		Servers: map[*WatchPath][]*WatchEntry{
 			wp1: nil,
 			wp2: nil,
 		},
@@ -114,33 +122,33 @@ func TestAllWatchesReturned(t *testing.T) {
 }
 
 func TestAggregateServers(t *testing.T) {
-	en1 := &consulapi.ServiceEntry{
+	en1 := &WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
 		Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
 		Service: &consulapi.AgentService{ID: "app", Port: 8000},
-	}
-	en2 := &consulapi.ServiceEntry{
+	}}
+	en2 := &WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
 		Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
 		Service: &consulapi.AgentService{ID: "app", Port: 8000},
-	}
-	en3 := &consulapi.ServiceEntry{
+	}}
+	en3 := &WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
 		Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
 		Service: &consulapi.AgentService{ID: "db", Port: 5000},
-	}
+	}}
 	wp1 := &WatchPath{Backend: "app"}
 	wp2 := &WatchPath{Backend: "app"}
 	wp3 := &WatchPath{Backend: "db"}
 	d := &backendData{
-		Servers: map[*WatchPath][]*consulapi.ServiceEntry{
-			wp1: []*consulapi.ServiceEntry{en1},
-			wp2: []*consulapi.ServiceEntry{en2},
-			wp3: []*consulapi.ServiceEntry{en3},
+		Servers: map[*WatchPath][]*WatchEntry{
+			wp1: []*WatchEntry{en1},
+			wp2: []*WatchEntry{en2},
+			wp3: []*WatchEntry{en3},
 		},
 		Backends: map[string][]*WatchPath{
 			"app": []*WatchPath{wp1, wp2},
 			"db":  []*WatchPath{wp3},
 		},
 	}
-	agg := aggregateServers(d)
+	agg := aggregateServers(&Config{}, d)
 	if len(agg) != 2 {
 		t.Fatalf("Bad: %v", agg)
 	}
@@ -169,22 +177,22 @@ func TestBuildTemplate(t *testing.T) {
 		"test-fixtures/simple.conf.out",
 		"test-fixtures/varnish.vcl.out",
 	}
-	servers := map[string][]*consulapi.ServiceEntry{
-		"app": []*consulapi.ServiceEntry{
-			&consulapi.ServiceEntry{
+	servers := map[string][]*WatchEntry{
+		"app": []*WatchEntry{
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
 				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
 				Service: &consulapi.AgentService{ID: "app", Port: 8000},
-			},
-			&consulapi.ServiceEntry{
+			}},
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
 				Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
 				Service: &consulapi.AgentService{ID: "app", Port: 8000},
-			},
+			}},
 		},
 	}
 
 	// Iterate through the list of templates to render
 	for idx, templatePath := range templates {
-		out, err := buildTemplate(templatePath, servers)
+		out, err := buildTemplate(nil, templatePath, newTemplateContext(&backendData{}, servers, nil))
 		if err != nil {
 			t.Fatalf("err: %v", err)
 		}
@@ -203,10 +211,7 @@ func TestBuildTemplate(t *testing.T) {
 
 func TestReload(t *testing.T) {
 	os.Remove("test_out")
-	conf := &Config{
-		ReloadCommand: "echo 'foo' > test_out",
-	}
-	if err := reload(conf); err != nil {
+	if err := reload("echo 'foo' > test_out"); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	bytes, err := ioutil.ReadFile("test_out")
@@ -277,26 +282,26 @@ func TestBackoff(t *testing.T) {
 }
 
 func TestFormatOutput(t *testing.T) {
-	inp := map[string][]*consulapi.ServiceEntry{
-		"foo": []*consulapi.ServiceEntry{
-			&consulapi.ServiceEntry{
+	inp := map[string][]*WatchEntry{
+		"foo": []*WatchEntry{
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
 				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
 				Service: &consulapi.AgentService{ID: "redis", Port: 8000},
-			},
-			&consulapi.ServiceEntry{
+			}},
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
 				Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
 				Service: &consulapi.AgentService{ID: "redis", Port: 1234},
-			},
+			}},
 		},
-		"bar": []*consulapi.ServiceEntry{
-			&consulapi.ServiceEntry{
+		"bar": []*WatchEntry{
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
 				Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
 				Service: &consulapi.AgentService{ID: "memcache", Port: 80},
-			},
-			&consulapi.ServiceEntry{
+			}},
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
 				Node:    &consulapi.Node{Node: "node4", Address: "127.0.0.4"},
 				Service: &consulapi.AgentService{ID: "memcache", Port: 10000},
-			},
+			}},
 		},
 	}
 
@@ -326,3 +331,1124 @@ func TestFormatOutput(t *testing.T) {
 		t.Fatalf("Bad: %v", bar)
 	}
 }
+
+func testRefreshData() (*backendData, []*WatchPath) {
+	d := &backendData{}
+	wp1 := addTestWatch(d, "app", testWatchEntry("node1", "127.0.0.1", "app", 8000))
+	wp2 := addTestWatch(d, "app", testWatchEntry("node3", "127.0.0.3", "app", 8000))
+	return d, []*WatchPath{wp1, wp2}
+}
+
+// testWatchEntry creates a passing entry for a service on a node
+func testWatchEntry(node, addr, id string, port int) *WatchEntry {
+	return &WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: node, Address: addr},
+		Service: &consulapi.AgentService{ID: id, Port: port},
+	}}
+}
+
+// addTestWatch adds a watch of a backend that returned the given entries
+func addTestWatch(d *backendData, backend string, entries ...*WatchEntry) *WatchPath {
+	if d.Servers == nil {
+		d.Servers = make(map[*WatchPath][]*WatchEntry)
+	}
+	if d.Backends == nil {
+		d.Backends = make(map[string][]*WatchPath)
+	}
+	wp := &WatchPath{Backend: backend}
+	d.Servers[wp] = entries
+	d.Backends[backend] = append(d.Backends[backend], wp)
+	return wp
+}
+
+func TestForceRefresh_CheckCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, watches := testRefreshData()
+	path := filepath.Join(dir, "haproxy.cfg")
+	checkOut := filepath.Join(dir, "check_out")
+	reloadOut := filepath.Join(dir, "reload_out")
+	conf := &Config{
+		watches:       watches,
+		Templates:     []string{"test-fixtures/simple.conf"},
+		Paths:         []string{path},
+		CheckCommand:  "cp {{path}} " + checkOut,
+		ReloadCommand: "echo 'foo' > " + reloadOut,
+	}
+
+	if forceRefresh(conf, d, conf.allOutputs()) {
+		t.Fatalf("unexpected exit")
+	}
+
+	// The check should have seen the rendered file
+	expect, err := ioutil.ReadFile("test-fixtures/simple.conf.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := ioutil.ReadFile(checkOut)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expect) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// And the file should be installed and reloaded
+	out, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expect) {
+		t.Fatalf("bad: %s", out)
+	}
+	if _, err := os.Stat(reloadOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestForceRefresh_CheckFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, watches := testRefreshData()
+	path := filepath.Join(dir, "haproxy.cfg")
+	reloadOut := filepath.Join(dir, "reload_out")
+	if err := ioutil.WriteFile(path, []byte("known good"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf := &Config{
+		watches:       watches,
+		Templates:     []string{"test-fixtures/simple.conf"},
+		Paths:         []string{path},
+		CheckCommand:  "exit 1",
+		ReloadCommand: "echo 'foo' > " + reloadOut,
+	}
+
+	if forceRefresh(conf, d, conf.allOutputs()) {
+		t.Fatalf("unexpected exit")
+	}
+
+	// The existing file should be untouched
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "known good" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// No reload should have happened
+	if _, err := os.Stat(reloadOut); !os.IsNotExist(err) {
+		t.Fatalf("unexpected reload: %v", err)
+	}
+
+	// No staged files should be left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("bad: %v", files)
+	}
+}
+
+func TestForceRefresh_CheckFailedOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, watches := testRefreshData()
+	path := filepath.Join(dir, "haproxy.cfg")
+	path2 := filepath.Join(dir, "varnish.vcl")
+	reloadOut := filepath.Join(dir, "reload_out")
+	reloadOut2 := filepath.Join(dir, "reload_out2")
+	conf := &Config{
+		watches: watches,
+		Outputs: []*OutputConfig{
+			&OutputConfig{
+				Template:      "test-fixtures/simple.conf",
+				Path:          path,
+				CheckCommand:  "true",
+				ReloadCommand: "echo 'foo' > " + reloadOut,
+			},
+			&OutputConfig{
+				Template:      "test-fixtures/varnish.vcl",
+				Path:          path2,
+				CheckCommand:  "exit 1",
+				ReloadCommand: "echo 'bar' > " + reloadOut2,
+			},
+		},
+	}
+
+	if forceRefresh(conf, d, conf.allOutputs()) {
+		t.Fatalf("unexpected exit")
+	}
+
+	// Only the output that passed its check is installed and reloaded
+	expect, err := ioutil.ReadFile("test-fixtures/simple.conf.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expect) {
+		t.Fatalf("bad: %s", out)
+	}
+	if _, err := os.Stat(reloadOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(path2); !os.IsNotExist(err) {
+		t.Fatalf("unexpected file: %v", err)
+	}
+	if _, err := os.Stat(reloadOut2); !os.IsNotExist(err) {
+		t.Fatalf("unexpected reload: %v", err)
+	}
+}
+
+func TestForceRefresh_ReloadFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, watches := testRefreshData()
+	path := filepath.Join(dir, "haproxy.cfg")
+	path2 := filepath.Join(dir, "varnish.vcl")
+	if err := ioutil.WriteFile(path, []byte("known good"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf := &Config{
+		watches:       watches,
+		Templates:     []string{"test-fixtures/simple.conf", "test-fixtures/varnish.vcl"},
+		Paths:         []string{path, path2},
+		ReloadCommand: "exit 1",
+	}
+
+	if forceRefresh(conf, d, conf.allOutputs()) {
+		t.Fatalf("unexpected exit")
+	}
+
+	// The previous file should be restored
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "known good" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// The file which did not exist before should be removed
+	if _, err := os.Stat(path2); !os.IsNotExist(err) {
+		t.Fatalf("unexpected file: %v", err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	os.Remove("test_out")
+	defer os.Remove("test_out")
+	if err := checkConfig("echo {{path}} > test_out", "haproxy.cfg"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	bytes, err := ioutil.ReadFile("test_out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(bytes) != "haproxy.cfg\n" {
+		t.Fatalf("bad: %v", bytes)
+	}
+
+	if err := checkConfig("exit 1", "haproxy.cfg"); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Paths are passed as a single argument
+	if runtime.GOOS == "windows" {
+		return
+	}
+	path := "haproxy's $HOME; `exit 1`.cfg"
+	if err := checkConfig("echo {{path}} > test_out", path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	bytes, err = ioutil.ReadFile("test_out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(bytes) != path+"\n" {
+		t.Fatalf("bad: %s", bytes)
+	}
+}
+
+func TestForceRefresh_Unchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, watches := testRefreshData()
+	path := filepath.Join(dir, "haproxy.cfg")
+	path2 := filepath.Join(dir, "varnish.vcl")
+	checkOut := filepath.Join(dir, "check_out")
+	reloadOut := filepath.Join(dir, "reload_out")
+
+	// Pre-populate the first file with the expected output
+	expect, err := ioutil.ReadFile("test-fixtures/simple.conf.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(path, expect, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conf := &Config{
+		watches:       watches,
+		Templates:     []string{"test-fixtures/simple.conf", "test-fixtures/varnish.vcl"},
+		Paths:         []string{path, path2},
+		CheckCommand:  "echo checked >> " + checkOut,
+		ReloadCommand: "echo 'foo' >> " + reloadOut,
+	}
+
+	// Only the second file should be written
+	if forceRefresh(conf, d, conf.allOutputs()) {
+		t.Fatalf("unexpected exit")
+	}
+	out, err := ioutil.ReadFile(checkOut)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "checked\n" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// Nothing changed, so no writes or reload should happen
+	if forceRefresh(conf, d, conf.allOutputs()) {
+		t.Fatalf("unexpected exit")
+	}
+	out, err = ioutil.ReadFile(checkOut)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "checked\n" {
+		t.Fatalf("bad: %s", out)
+	}
+	out, err = ioutil.ReadFile(reloadOut)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "foo\n" {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestForceRefresh_PerOutputReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, watches := testRefreshData()
+	path := filepath.Join(dir, "haproxy.cfg")
+	path2 := filepath.Join(dir, "varnish.vcl")
+	reloadOut := filepath.Join(dir, "reload_out")
+	reloadOut2 := filepath.Join(dir, "reload_out2")
+
+	// Pre-populate the first file with the expected output
+	expect, err := ioutil.ReadFile("test-fixtures/simple.conf.out")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(path, expect, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conf := &Config{
+		watches: watches,
+		Outputs: []*OutputConfig{
+			&OutputConfig{
+				Template:      "test-fixtures/simple.conf",
+				Path:          path,
+				ReloadCommand: "echo 'foo' > " + reloadOut,
+			},
+			&OutputConfig{
+				Template:      "test-fixtures/varnish.vcl",
+				Path:          path2,
+				ReloadCommand: "echo 'bar' > " + reloadOut2,
+				Mode:          "0600",
+			},
+		},
+	}
+
+	if forceRefresh(conf, d, conf.allOutputs()) {
+		t.Fatalf("unexpected exit")
+	}
+
+	// Only the changed output should be reloaded
+	if _, err := os.Stat(reloadOut); !os.IsNotExist(err) {
+		t.Fatalf("unexpected reload: %v", err)
+	}
+	out, err := ioutil.ReadFile(reloadOut2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "bar\n" {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// The new file should use the configured mode
+	info, err := os.Stat(path2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Fatalf("bad: %v", info.Mode())
+	}
+}
+
+func TestMaybeRefresh_Quiet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, watches := testRefreshData()
+	path := filepath.Join(dir, "haproxy.cfg")
+	path2 := filepath.Join(dir, "varnish.vcl")
+	quiet := 10 * time.Millisecond
+	conf := &Config{
+		watches:       watches,
+		ReloadCommand: "true",
+		Outputs: []*OutputConfig{
+			&OutputConfig{
+				Template: "test-fixtures/simple.conf",
+				Path:     path,
+			},
+			&OutputConfig{
+				Template: "test-fixtures/varnish.vcl",
+				Path:     path2,
+				Quiet:    &quiet,
+			},
+		},
+	}
+
+	// The first output is written immediately, the second waits
+	if maybeRefresh(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(path2); !os.IsNotExist(err) {
+		t.Fatalf("unexpected file: %v", err)
+	}
+	if len(d.pending) != 1 || d.pending[1] == nil {
+		t.Fatalf("bad: %v", d.pending)
+	}
+
+	// The second output is written once the quiet period ends
+	select {
+	case <-d.refreshTimer:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	if refreshDue(conf, d) {
+		t.Fatalf("unexpected exit")
+	}
+	if _, err := os.Stat(path2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(d.pending) != 0 || d.refreshTimer != nil {
+		t.Fatalf("bad: %v %v", d.pending, d.refreshTimer)
+	}
+}
+
+func TestPendingRefresh_Due(t *testing.T) {
+	now := time.Now()
+	p := &pendingRefresh{
+		quiet:   now.Add(time.Second),
+		maxWait: now.Add(time.Minute),
+	}
+	if !p.due().Equal(p.quiet) {
+		t.Fatalf("bad: %v", p.due())
+	}
+	p.quiet = now.Add(time.Hour)
+	if !p.due().Equal(p.maxWait) {
+		t.Fatalf("bad: %v", p.due())
+	}
+}
+
+func TestFilterEntries(t *testing.T) {
+	passing := &consulapi.HealthCheck{Status: HealthPassing}
+	warning := &consulapi.HealthCheck{Status: HealthWarning}
+	critical := &consulapi.HealthCheck{Status: HealthCritical}
+	en1 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node1"},
+		Service: &consulapi.AgentService{ID: "app", Tags: []string{"a", "b"}},
+		Checks:  []*consulapi.HealthCheck{passing},
+	}
+	en2 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node2"},
+		Service: &consulapi.AgentService{ID: "app", Tags: []string{"a", "canary"}},
+		Checks:  []*consulapi.HealthCheck{passing, warning},
+	}
+	en3 := &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Node: "node3"},
+		Service: &consulapi.AgentService{ID: "app", Tags: []string{"a", "b"}},
+		Checks:  []*consulapi.HealthCheck{warning, critical},
+	}
+	entries := []*consulapi.ServiceEntry{en1, en2, en3}
+
+	type match struct {
+		watch  *WatchPath
+		expect []*consulapi.ServiceEntry
+	}
+	inps := []match{
+		{&WatchPath{Health: HealthAny}, entries},
+		{&WatchPath{Tags: []string{"a", "b"}, Health: HealthAny}, []*consulapi.ServiceEntry{en1, en3}},
+		{&WatchPath{ExcludeTags: []string{"canary"}, Health: HealthAny}, []*consulapi.ServiceEntry{en1, en3}},
+		{&WatchPath{ExcludeTags: []string{"b", "canary"}, Health: HealthAny}, nil},
+		{&WatchPath{Health: HealthWarning}, []*consulapi.ServiceEntry{en1, en2}},
+		{&WatchPath{Tags: []string{"a"}, ExcludeTags: []string{"canary"}, Health: HealthWarning},
+			[]*consulapi.ServiceEntry{en1}},
+	}
+	for idx, inp := range inps {
+		out := filterEntries(inp.watch, entries)
+		if !reflect.DeepEqual(out, inp.expect) {
+			t.Fatalf("bad: %d %v", idx, out)
+		}
+	}
+
+	// Instances in maintenance are only included with any health
+	en2.Checks = append(en2.Checks, &consulapi.HealthCheck{CheckID: "_node_maintenance", Status: HealthCritical})
+	out := filterEntries(&WatchPath{Health: HealthWarning}, entries)
+	if !reflect.DeepEqual(out, []*consulapi.ServiceEntry{en1}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestAggregateHealth(t *testing.T) {
+	passing := &consulapi.HealthCheck{Status: HealthPassing}
+	warning := &consulapi.HealthCheck{Status: HealthWarning}
+	critical := &consulapi.HealthCheck{Status: HealthCritical}
+	if s := aggregateHealth(nil); s != HealthPassing {
+		t.Fatalf("bad: %v", s)
+	}
+	if s := aggregateHealth([]*consulapi.HealthCheck{passing, warning}); s != HealthWarning {
+		t.Fatalf("bad: %v", s)
+	}
+	if s := aggregateHealth([]*consulapi.HealthCheck{critical, warning}); s != HealthCritical {
+		t.Fatalf("bad: %v", s)
+	}
+}
+
+func TestAggregateHealth_Maintenance(t *testing.T) {
+	critical := &consulapi.HealthCheck{Status: HealthCritical}
+	nodeMaint := &consulapi.HealthCheck{CheckID: "_node_maintenance", Status: HealthCritical}
+	serviceMaint := &consulapi.HealthCheck{CheckID: "_service_maintenance:redis", Status: HealthCritical}
+	if s := aggregateHealth([]*consulapi.HealthCheck{critical, nodeMaint}); s != HealthMaint {
+		t.Fatalf("bad: %v", s)
+	}
+	if s := aggregateHealth([]*consulapi.HealthCheck{serviceMaint}); s != HealthMaint {
+		t.Fatalf("bad: %v", s)
+	}
+}
+
+func TestFormatOutput_Health(t *testing.T) {
+	inp := map[string][]*WatchEntry{
+		"foo": []*WatchEntry{
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "redis", Port: 8000},
+				Checks: []*consulapi.HealthCheck{
+					&consulapi.HealthCheck{CheckID: "serfHealth", Name: "Serf", Status: HealthPassing},
+					&consulapi.HealthCheck{CheckID: "service:redis", Name: "Redis", Status: HealthWarning,
+						ServiceID: "redis"},
+				},
+			}},
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+				Service: &consulapi.AgentService{ID: "redis", Port: 8000},
+				Checks: []*consulapi.HealthCheck{
+					&consulapi.HealthCheck{CheckID: "service:redis", Status: HealthCritical},
+				},
+			}},
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
+				Service: &consulapi.AgentService{ID: "redis", Port: 8000},
+				Checks: []*consulapi.HealthCheck{
+					&consulapi.HealthCheck{CheckID: "_node_maintenance", Status: HealthCritical},
+				},
+			}},
+		},
+	}
+
+	foo := formatOutput(inp)["foo"]
+	if len(foo) != 3 {
+		t.Fatalf("bad: %v", foo)
+	}
+	if foo[0].Health != HealthWarning || foo[1].Health != HealthCritical || foo[2].Health != HealthMaint {
+		t.Fatalf("bad: %v %v %v", foo[0].Health, foo[1].Health, foo[2].Health)
+	}
+	checks := []*CheckEntry{
+		&CheckEntry{ID: "serfHealth", Name: "Serf", Status: HealthPassing},
+		&CheckEntry{ID: "service:redis", Name: "Redis", Status: HealthWarning, ServiceID: "redis"},
+	}
+	if !reflect.DeepEqual(foo[0].Checks, checks) {
+		t.Fatalf("bad: %v", foo[0].Checks)
+	}
+
+	// Unhealthy servers are rendered as disabled
+	if foo[0].String() != "server node1_redis 127.0.0.1:8000" {
+		t.Fatalf("Bad: %v", foo[0])
+	}
+	if foo[1].String() != "server node2_redis 127.0.0.2:8000 disabled" {
+		t.Fatalf("Bad: %v", foo[1])
+	}
+	if foo[2].String() != "server node3_redis 127.0.0.3:8000 disabled" {
+		t.Fatalf("Bad: %v", foo[2])
+	}
+}
+
+func TestFormatOutput_Metadata(t *testing.T) {
+	wp := &WatchPath{Spec: "foo=redis@dc2", Backend: "foo", Service: "redis", Datacenter: "dc2"}
+	inp := map[string][]*WatchEntry{
+		"foo": []*WatchEntry{
+			&WatchEntry{
+				ServiceEntry: &consulapi.ServiceEntry{
+					Node: &consulapi.Node{Node: "0_node1", Address: "127.0.0.1", Datacenter: "dc2",
+						Meta: map[string]string{"rack": "r1"}},
+					Service: &consulapi.AgentService{ID: "redis", Service: "redis", Port: 8000,
+						Address: "10.0.0.1", Meta: map[string]string{"version": "2"},
+						Weights: consulapi.AgentWeights{Passing: 10, Warning: 1}},
+				},
+				Watch:    wp,
+				NodeName: "node1",
+			},
+		},
+	}
+
+	foo := formatOutput(inp)["foo"]
+	if len(foo) != 1 {
+		t.Fatalf("bad: %v", foo)
+	}
+	se := foo[0]
+	if se.Node != "0_node1" || se.NodeName != "node1" {
+		t.Fatalf("bad: %v %v", se.Node, se.NodeName)
+	}
+	if se.Datacenter != "dc2" || se.Spec != "foo=redis@dc2" {
+		t.Fatalf("bad: %v %v", se.Datacenter, se.Spec)
+	}
+	if se.ServiceAddress != "10.0.0.1" {
+		t.Fatalf("bad: %v", se.ServiceAddress)
+	}
+	if se.NodeMeta["rack"] != "r1" || se.ServiceMeta["version"] != "2" {
+		t.Fatalf("bad: %v %v", se.NodeMeta, se.ServiceMeta)
+	}
+	if se.Weights != (Weights{Passing: 10, Warning: 1}) {
+		t.Fatalf("bad: %v", se.Weights)
+	}
+}
+
+func TestFormatOutput_Address(t *testing.T) {
+	nodeWatch := &WatchPath{Backend: "foo", Address: AddressNode}
+	inp := map[string][]*WatchEntry{
+		"foo": []*WatchEntry{
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "web1", Port: 8000, Address: "172.17.0.2"},
+			}},
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node1", Address: "127.0.0.1"},
+				Service: &consulapi.AgentService{ID: "web2", Port: 8000},
+			}},
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node2", Address: "127.0.0.2"},
+				Service: &consulapi.AgentService{ID: "web3", Port: 8000, Address: "web3.example.com"},
+			}},
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node3", Address: "127.0.0.3"},
+				Service: &consulapi.AgentService{ID: "web4", Port: 8000, Address: "172.17.0.4"},
+			}, Watch: nodeWatch},
+			&WatchEntry{ServiceEntry: &consulapi.ServiceEntry{
+				Node:    &consulapi.Node{Node: "node4", Address: "::1"},
+				Service: &consulapi.AgentService{ID: "web5", Port: 8000},
+			}},
+		},
+	}
+
+	foo := formatOutput(inp)["foo"]
+	if len(foo) != 5 {
+		t.Fatalf("bad: %v", foo)
+	}
+	expect := []string{
+		"server node1_web1 172.17.0.2:8000",
+		"server node1_web2 127.0.0.1:8000",
+		"server node2_web3 web3.example.com:8000",
+		"server node3_web4 127.0.0.3:8000",
+		"server node4_web5 [::1]:8000",
+	}
+	for idx, se := range foo {
+		if se.String() != expect[idx] {
+			t.Fatalf("Bad: %v", se)
+		}
+	}
+
+	// Hostnames do not have an IP
+	if foo[0].IP.String() != "172.17.0.2" || foo[2].IP != nil {
+		t.Fatalf("bad: %v %v", foo[0].IP, foo[2].IP)
+	}
+	if foo[2].Address != "web3.example.com" {
+		t.Fatalf("bad: %v", foo[2].Address)
+	}
+}
+
+func TestUpdateWatch(t *testing.T) {
+	wp := &WatchPath{Backend: "app"}
+	d := &backendData{
+		Servers:  make(map[*WatchPath][]*WatchEntry),
+		Backends: map[string][]*WatchPath{"app": []*WatchPath{wp}},
+		ChangeCh: make(chan struct{}, 1),
+	}
+	conf := &Config{watches: []*WatchPath{wp}}
+	servers := testEntries(2)
+	errFailed := fmt.Errorf("failed")
+	notified := func() bool {
+		select {
+		case <-d.ChangeCh:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// A failed first read leaves the watch not ready
+	if !updateWatch(d, wp, nil, errFailed) || !notified() {
+		t.Fatalf("expected change")
+	}
+	if _, ok := d.Servers[wp]; ok || allWatchesReturned(conf, d) {
+		t.Fatalf("unexpected servers")
+	}
+	if s := backendStatus(d)["app"]; s != StatusError {
+		t.Fatalf("bad: %v", s)
+	}
+	if updateWatch(d, wp, nil, errFailed) || notified() {
+		t.Fatalf("unexpected change")
+	}
+
+	// A successful read is stored
+	if !updateWatch(d, wp, servers, nil) || !notified() {
+		t.Fatalf("expected change")
+	}
+	if !allWatchesReturned(conf, d) || backendStatus(d)["app"] != StatusOK {
+		t.Fatalf("expected ready")
+	}
+	if updateWatch(d, wp, servers, nil) || notified() {
+		t.Fatalf("unexpected change")
+	}
+
+	// A failure keeps the previous servers
+	if !updateWatch(d, wp, nil, errFailed) || !notified() {
+		t.Fatalf("expected change")
+	}
+	if len(d.Servers[wp]) != 2 || backendStatus(d)["app"] != StatusStale {
+		t.Fatalf("bad: %v", d.Servers[wp])
+	}
+
+	// Recovering with the same servers is a change of status
+	if !updateWatch(d, wp, servers, nil) || !notified() {
+		t.Fatalf("expected change")
+	}
+	if !updateWatch(d, wp, nil, nil) || backendStatus(d)["app"] != StatusEmpty {
+		t.Fatalf("expected empty")
+	}
+}
+
+func TestAllWatchesReturned_ErrorPolicy(t *testing.T) {
+	wp1 := &WatchPath{Backend: "app"}
+	wp2 := &WatchPath{Backend: "db"}
+	d := &backendData{
+		Servers: map[*WatchPath][]*WatchEntry{wp1: testEntries(1)},
+		status: map[*WatchPath]*watchStatus{
+			wp1: &watchStatus{Read: true},
+			wp2: &watchStatus{Err: fmt.Errorf("failed")},
+		},
+	}
+	conf := &Config{watches: []*WatchPath{wp1, wp2}}
+	type match struct {
+		policy string
+		expect bool
+	}
+	inps := []match{
+		{PolicyWait, false},
+		{PolicyRender, true},
+		{PolicyHold, false},
+	}
+	for _, inp := range inps {
+		conf.ErrorPolicy = inp.policy
+		if out := allWatchesReturned(conf, d); out != inp.expect {
+			t.Fatalf("bad: %v %v", inp.policy, out)
+		}
+	}
+
+	// A watch that failed after returning servers
+	d.Servers[wp2] = testEntries(1)
+	d.status[wp2].Read = true
+	inps = []match{
+		{PolicyWait, true},
+		{PolicyRender, true},
+		{PolicyHold, false},
+	}
+	for _, inp := range inps {
+		conf.ErrorPolicy = inp.policy
+		if out := allWatchesReturned(conf, d); out != inp.expect {
+			t.Fatalf("bad: %v %v", inp.policy, out)
+		}
+	}
+}
+
+func TestBackendStatus(t *testing.T) {
+	wp1 := &WatchPath{Backend: "app"}
+	wp2 := &WatchPath{Backend: "app"}
+	wp3 := &WatchPath{Backend: "db"}
+	wp4 := &WatchPath{Backend: "cache"}
+	wp5 := &WatchPath{Backend: "web"}
+	d := &backendData{
+		Servers: map[*WatchPath][]*WatchEntry{
+			wp1: testEntries(1),
+			wp2: nil,
+			wp3: nil,
+			wp4: testEntries(1),
+		},
+		Backends: map[string][]*WatchPath{
+			"app":   []*WatchPath{wp1, wp2},
+			"db":    []*WatchPath{wp3},
+			"cache": []*WatchPath{wp4},
+			"web":   []*WatchPath{wp5},
+		},
+		status: map[*WatchPath]*watchStatus{
+			wp1: &watchStatus{Read: true},
+			wp2: &watchStatus{Read: true},
+			wp3: &watchStatus{Read: true},
+			wp5: &watchStatus{Err: fmt.Errorf("failed")},
+		},
+	}
+	expect := map[string]string{
+		"app":   StatusOK,
+		"db":    StatusEmpty,
+		"cache": StatusStale,
+		"web":   StatusError,
+	}
+	if out := backendStatus(d); !reflect.DeepEqual(out, expect) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestBuildTemplate_Status(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-haproxy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "status.conf")
+	raw := `{{if eq (status "app") "ok"}}{{range .app}}{{.}}{{end}}{{else}}# app is {{status "app"}}{{end}}`
+	if err := ioutil.WriteFile(path, []byte(raw), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	servers := map[string][]*WatchEntry{"app": testEntries(1)}
+	out, err := buildTemplate(nil, path, newTemplateContext(&backendData{}, servers, map[string]string{"app": StatusOK}))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "server node1_app 127.0.0.1:8000" {
+		t.Fatalf("bad: %s", out)
+	}
+	out, err = buildTemplate(nil, path, newTemplateContext(&backendData{}, servers, map[string]string{"app": StatusStale}))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "# app is stale" {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestQueryOptions(t *testing.T) {
+	conf := &Config{}
+	opts, maxStale := queryOptions(conf, &WatchPath{Datacenter: "dc2"})
+	if opts.Datacenter != "dc2" || opts.WaitTime != waitTime || opts.AllowStale || opts.RequireConsistent {
+		t.Fatalf("bad: %#v", opts)
+	}
+	if maxStale != 0 {
+		t.Fatalf("bad: %v", maxStale)
+	}
+
+	conf = &Config{Consistency: ConsistencyStale, MaxStale: 5 * time.Second, WaitTime: 30 * time.Second}
+	opts, maxStale = queryOptions(conf, &WatchPath{})
+	if !opts.AllowStale || opts.WaitTime != 30*time.Second || maxStale != 5*time.Second {
+		t.Fatalf("bad: %#v %v", opts, maxStale)
+	}
+
+	// The settings of a backend take precedence
+	wp := &WatchPath{Consistency: ConsistencyConsistent, MaxStale: time.Second, WaitTime: time.Minute}
+	opts, maxStale = queryOptions(conf, wp)
+	if opts.AllowStale || !opts.RequireConsistent || opts.WaitTime != time.Minute || maxStale != time.Second {
+		t.Fatalf("bad: %#v %v", opts, maxStale)
+	}
+}
+
+func TestRunSharedWatch_MaxStale(t *testing.T) {
+	var queries []string
+	var lock sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		lock.Unlock()
+
+		// Stale reads are far behind the leader
+		w.Header().Set("X-Consul-Index", "5")
+		w.Header().Set("X-Consul-KnownLeader", "true")
+		if _, ok := r.URL.Query()["stale"]; ok {
+			w.Header().Set("X-Consul-LastContact", "30000")
+		} else {
+			w.Header().Set("X-Consul-LastContact", "0")
+		}
+		w.Write([]byte(`[{"Node": {"Node": "node1", "Address": "127.0.0.1"},
+			"Service": {"ID": "redis", "Service": "redis", "Port": 8000}}]`))
+	}))
+	defer srv.Close()
+
+	conf := &Config{
+		Address: strings.TrimPrefix(srv.URL, "http://"),
+		DryRun:  true,
+	}
+	clients, err := newConsulClients(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	wp := &WatchPath{Spec: "app=redis", Backend: "app", Service: "redis",
+		Consistency: ConsistencyStale, MaxStale: 10 * time.Second}
+	d := &backendData{
+		Clients:  clients,
+		Servers:  make(map[*WatchPath][]*WatchEntry),
+		ChangeCh: make(chan struct{}, 1),
+		StopCh:   make(chan struct{}),
+	}
+	conf.watches = []*WatchPath{wp}
+	runSharedWatch(conf, d, groupWatches(conf)[0])
+
+	// The stale result is read again from the leader
+	if len(queries) != 2 {
+		t.Fatalf("bad: %v", queries)
+	}
+	if !strings.Contains(queries[0], "stale") || strings.Contains(queries[1], "stale") {
+		t.Fatalf("bad: %v", queries)
+	}
+	if len(d.Servers[wp]) != 1 {
+		t.Fatalf("bad: %v", d.Servers[wp])
+	}
+	if status := d.status[wp]; status.LastContact != 0 || !status.KnownLeader {
+		t.Fatalf("bad: %#v", status)
+	}
+}
+
+func TestNextWaitIndex(t *testing.T) {
+	type match struct {
+		last, index uint64
+		expect      uint64
+		reset       bool
+	}
+	inps := []match{
+		{0, 10, 10, false},
+		{10, 10, 10, false},
+		{10, 20, 20, false},
+		{20, 5, 0, true},
+		{20, 0, 0, true},
+		{0, 0, 0, true},
+	}
+	for _, inp := range inps {
+		index, reset := nextWaitIndex(inp.last, inp.index)
+		if index != inp.expect || reset != inp.reset {
+			t.Fatalf("bad: %v %d %v", inp, index, reset)
+		}
+	}
+}
+
+func TestRunSharedWatch_IndexReset(t *testing.T) {
+	// The index goes backwards, then is zero
+	indexes := []string{"10", "20", "5", "0", "30"}
+	var queries []string
+	var lock sync.Mutex
+	stopCh := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		queries = append(queries, r.URL.Query().Get("index"))
+		if len(queries) == len(indexes) {
+			close(stopCh)
+		}
+		w.Header().Set("X-Consul-Index", indexes[len(queries)-1])
+		w.Header().Set("X-Consul-KnownLeader", "true")
+		w.Write([]byte(`[{"Node": {"Node": "node1", "Address": "127.0.0.1"},
+			"Service": {"ID": "redis", "Service": "redis", "Port": 8000}}]`))
+	}))
+	defer srv.Close()
+
+	conf := &Config{
+		Address:       strings.TrimPrefix(srv.URL, "http://"),
+		QueryInterval: 20 * time.Millisecond,
+	}
+	clients, err := newConsulClients(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	wp := &WatchPath{Spec: "app=redis", Backend: "app", Service: "redis"}
+	d := &backendData{
+		Clients:  clients,
+		Servers:  make(map[*WatchPath][]*WatchEntry),
+		ChangeCh: make(chan struct{}, 1),
+		StopCh:   stopCh,
+	}
+	start := time.Now()
+	conf.watches = []*WatchPath{wp}
+	runSharedWatch(conf, d, groupWatches(conf)[0])
+
+	// Queries are limited by the interval
+	if elapsed := time.Since(start); elapsed < 4*conf.QueryInterval {
+		t.Fatalf("bad: %v", elapsed)
+	}
+
+	// A reset index starts the query over
+	expect := []string{"", "10", "20", "", ""}
+	if !reflect.DeepEqual(queries, expect) {
+		t.Fatalf("bad: %#v", queries)
+	}
+	if status := d.status[wp]; status.IndexResets != 2 {
+		t.Fatalf("bad: %#v", status)
+	}
+}
+
+func TestGroupWatches(t *testing.T) {
+	var watches []*WatchPath
+	for _, spec := range []string{
+		"app=web",
+		"web=web",
+		"canary=canary.web",
+		"all=web?health=any",
+		"warn=web?health=warning",
+		"east=web@east",
+		"stale=web?consistency=stale",
+		"other=web:8080",
+	} {
+		wp, err := parseWatchPath(spec)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		watches = append(watches, wp)
+	}
+	conf := &Config{watches: watches}
+
+	groups := groupWatches(conf)
+	expect := []string{
+		"app=web, web=web, other=web:8080",
+		"canary=canary.web",
+		"all=web?health=any, warn=web?health=warning",
+		"east=web@east",
+		"stale=web?consistency=stale",
+	}
+	if len(groups) != len(expect) {
+		t.Fatalf("bad: %v", groups)
+	}
+	for i, group := range groups {
+		if group.String() != expect[i] {
+			t.Fatalf("bad: %d %s", i, group)
+		}
+	}
+	if !reflect.DeepEqual(groups[0].Indexes, []int{0, 1, 7}) {
+		t.Fatalf("bad: %v", groups[0].Indexes)
+	}
+}
+
+func TestRunSharedWatch_FanOut(t *testing.T) {
+	var queries int
+	var lock sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		queries++
+		lock.Unlock()
+		w.Header().Set("X-Consul-Index", "5")
+		w.Header().Set("X-Consul-KnownLeader", "true")
+		w.Header().Set("X-Consul-LastContact", "0")
+		w.Write([]byte(`[{"Node": {"Node": "node1", "Address": "127.0.0.1"},
+			"Service": {"ID": "web", "Service": "web", "Tags": ["canary"], "Port": 8000}},
+			{"Node": {"Node": "node2", "Address": "127.0.0.2"},
+			"Service": {"ID": "web", "Service": "web", "Port": 8000}}]`))
+	}))
+	defer srv.Close()
+
+	conf := &Config{
+		Address: strings.TrimPrefix(srv.URL, "http://"),
+		DryRun:  true,
+	}
+	for _, spec := range []string{"app=web", "canary=!canary.web", "alt=web:9000"} {
+		wp, err := parseWatchPath(spec)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conf.watches = append(conf.watches, wp)
+	}
+	clients, err := newConsulClients(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d := &backendData{
+		Clients:  clients,
+		Servers:  make(map[*WatchPath][]*WatchEntry),
+		ChangeCh: make(chan struct{}, 1),
+		StopCh:   make(chan struct{}),
+	}
+	groups := groupWatches(conf)
+	if len(groups) != 1 {
+		t.Fatalf("bad: %v", groups)
+	}
+	runSharedWatch(conf, d, groups[0])
+
+	// A single query serves every watch path
+	if queries != 1 {
+		t.Fatalf("bad: %d", queries)
+	}
+
+	// Each watch path is filtered and patched separately
+	app := d.Servers[conf.watches[0]]
+	if len(app) != 2 || app[0].Node.Node != "0_node1" || app[0].Service.Port != 8000 {
+		t.Fatalf("bad: %v", app)
+	}
+	canary := d.Servers[conf.watches[1]]
+	if len(canary) != 1 || canary[0].Node.Node != "1_node2" || canary[0].NodeName != "node2" {
+		t.Fatalf("bad: %v", canary)
+	}
+	alt := d.Servers[conf.watches[2]]
+	if len(alt) != 2 || alt[0].Node.Node != "2_node1" || alt[0].Service.Port != 9000 {
+		t.Fatalf("bad: %v", alt)
+	}
+	if app[0].Service == alt[0].Service || app[0].Node == alt[0].Node {
+		t.Fatalf("entries should not be shared")
+	}
+	for _, wp := range conf.watches {
+		if status := d.status[wp]; status == nil || !status.Read || !status.KnownLeader {
+			t.Fatalf("bad: %#v", status)
+		}
+	}
+}